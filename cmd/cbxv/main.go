@@ -2,7 +2,9 @@ package main
 
 import (
 	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/mftb0/cbxv/internal/model"
 	"github.com/mftb0/cbxv/internal/ui"
@@ -28,6 +30,8 @@ func update(m *model.Model, u *ui.UI, msgChan chan util.Message, msgHandlers *Me
 			(msg.TypeName != "quit" &&
 				msg.TypeName != "openFile" &&
 				msg.TypeName != "openFileResult" &&
+				msg.TypeName != "passwordRequired" &&
+				msg.TypeName != "enterPassword" &&
 				msg.TypeName != "toggleDirection" &&
 				msg.TypeName != "setFullscreen") {
 			continue
@@ -59,6 +63,19 @@ func update(m *model.Model, u *ui.UI, msgChan chan util.Message, msgHandlers *Me
 	}
 }
 
+// Ctrl-c or being killed goes through quit, same as closing the
+// window, so the open file is closed and its tmp dir removed. A
+// second signal isn't caught, in case quitting is stuck
+func handleSignals(messenger util.Messenger) {
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sigs
+		signal.Stop(sigs)
+		messenger(util.Message{TypeName: "quit"})
+	}()
+}
+
 // Setup the model
 // Setup the ui
 // Create messageHandlers
@@ -67,12 +84,16 @@ func update(m *model.Model, u *ui.UI, msgChan chan util.Message, msgHandlers *Me
 // Shutdown UI threads
 // Exit
 func main() {
+	// Clean up after any cbxv that didn't
+	util.RemoveOrphanedTmpDirs()
+
 	msgChan := make(chan util.Message)
 	md := model.ProgramMetadata{Name: NAME, Version: VERSION}
 	messenger := func(m util.Message) { msgChan <- m }
 	m := model.NewModel(md, messenger)
 	u := ui.NewUI(m, messenger)
 	msgHandlers := NewMessageHandlers(m, u)
+	handleSignals(messenger)
 
 	go update(m, u, msgChan, msgHandlers)
 
@@ -5,13 +5,35 @@ import (
     "fmt"
     "path/filepath"
     "strconv"
+    "strings"
     "time"
 
+    "github.com/gotk3/gotk3/glib"
     "github.com/mftb0/cbxv/internal/model"
     "github.com/mftb0/cbxv/internal/ui"
     "github.com/mftb0/cbxv/internal/util"
 )
 
+// Most broken pages listed by name in the open summary
+const MAX_LISTED_PROBLEMS = 10
+
+// Broken pages don't stop a cbx from opening, but
+// the user should know what they're missing
+func problemsSummary(problems []model.PageProblem, pageCount int) string {
+    var b strings.Builder
+    fmt.Fprintf(&b, "%d of %d pages couldn't be read and are shown as broken pages\n",
+        len(problems), pageCount)
+    for i, p := range problems {
+        if i == MAX_LISTED_PROBLEMS {
+            fmt.Fprintf(&b, "\n...and %d more", len(problems)-i)
+            break
+        }
+        fmt.Fprintf(&b, "\n<b>%s</b> %s", glib.MarkupEscapeText(p.FilePath),
+            glib.MarkupEscapeText(p.Error))
+    }
+    return b.String()
+}
+
 /* 
  * Messages are just the generic way to communicate with the app
  * They can be looked up by name and take a single argument
@@ -105,6 +127,35 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
         m.RefreshSpreads()
     }
 
+    handlers.List["setFitModeWindow"] = func(data string) {
+        m.FitMode = model.FIT_WINDOW
+        m.StoreLayout()
+    }
+
+    handlers.List["setFitModeWidth"] = func(data string) {
+        m.FitMode = model.FIT_WIDTH
+        m.StoreLayout()
+    }
+
+    handlers.List["setFitModeHeight"] = func(data string) {
+        m.FitMode = model.FIT_HEIGHT
+        m.StoreLayout()
+    }
+
+    handlers.List["setFitModeOriginal"] = func(data string) {
+        m.FitMode = model.FIT_ORIGINAL
+        m.StoreLayout()
+    }
+
+    handlers.List["toggleNoUpscale"] = func(data string) {
+        m.NoUpscale = !m.NoUpscale
+        m.StoreLayout()
+    }
+
+    handlers.List["cycleScaleFilter"] = func(data string) {
+        m.ScaleFilter = m.ScaleFilter.Next()
+    }
+
     handlers.List["toggleDirection"] = func(data string) {
         // Toggle the read mode
         if m.Direction == model.LTR {
@@ -134,6 +185,14 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
     // the model will emit an "openFileResult", see below
     handlers.List["openFile"] = func(data string) {
         handlers.List["closeFile"]("")
+        // Dropped directories come with a trailing slash
+        if data != "" {
+            data = filepath.Clean(data)
+        }
+        // A later volume of a rar opens the whole set
+        if first, ok := util.FirstRarVolume(data); ok {
+            data = first
+        }
         m.FilePath = data
         m.BrowseDir = filepath.Dir(data)
 
@@ -156,6 +215,8 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
             u.DisplayErrorDlg(msg)
 		} else {
             if r.Code == model.OK {
+                // Before loading, which can find more
+                show := m.AddProblems(r.Problems)
                 m.LoadCbxFile()
                 if len(m.Spreads) > 0 {
                     m.PageIndex = m.Spreads[m.SpreadIndex].VersoPage()
@@ -163,6 +224,9 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
                     // If there are no spreads, bad file?
                     m.PageIndex = 0
                 }
+                if show {
+                    u.DisplayWarningDlg(problemsSummary(m.Problems, len(m.Pages)))
+                }
             } else {
                 msg := fmt.Sprintf("%s, %d", r.Description, r.Code)
                 u.DisplayErrorDlg(msg)
@@ -172,6 +236,45 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
 	    m.Loading = false
     }
 
+    // Pages that were broken when they were loaded, rather than
+    // when the cbx was opened, see Model.reportProblems. Only the
+    // first time for a cbx, after that they're counted in the hud
+    handlers.List["pageProblems"] = func(data string) {
+        u.DisplayWarningDlg(problemsSummary(m.Problems, len(m.Pages)))
+    }
+
+    // The cbx being opened is encrypted, ask for the password
+    // and try again, or give up if the user cancels
+    handlers.List["passwordRequired"] = func(data string) {
+        var r model.PasswordRequest
+        err := json.Unmarshal([]byte(data), &r)
+        if err != nil {
+            msg := fmt.Sprintf("Error unable to decode passwordRequired: %s", err)
+            u.DisplayErrorDlg(msg)
+        } else {
+            pw, remember, ok := u.PromptPassword(filepath.Base(r.FilePath), r.Wrong)
+            if ok {
+                buf, _ := json.Marshal(model.PasswordResponse{Password: pw, Remember: remember})
+                m.SendMessage(util.Message{TypeName: "enterPassword", Data: string(buf)})
+                return
+            }
+        }
+        handlers.List["closeFile"]("")
+        m.Loading = false
+    }
+
+    handlers.List["enterPassword"] = func(data string) {
+        var r model.PasswordResponse
+        err := json.Unmarshal([]byte(data), &r)
+        if err != nil {
+            msg := fmt.Sprintf("Error unable to decode enterPassword: %s", err)
+            u.DisplayErrorDlg(msg)
+            return
+        }
+        m.SetPassword(r.Password, r.Remember)
+        go m.OpenCbxFile()
+    }
+
     handlers.List["closeFile"] = func(data string) {
         m.CloseCbxFile()
     }
@@ -195,10 +298,17 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
     }
 
     handlers.List["exportPage"] = func(data string) {
-        srcPath := m.Pages[m.PageIndex].FilePath
+        name := m.Pages[m.PageIndex].FilePath
         dstPath := data
         m.ExportDir = filepath.Dir(dstPath)
-        util.ExportPage(srcPath, dstPath)
+        util.ExportPage(m.Source, name, dstPath)
+    }
+
+    // Page names change with the encoding, so the file is opened
+    // again, the new encoding is kept in the layout
+    handlers.List["setNameEncoding"] = func(data string) {
+        m.SetNameEncoding(util.NameEncoding(data))
+        handlers.List["openFile"](m.FilePath)
     }
 
     handlers.List["toggleBookmark"] = func(data string) {
@@ -229,6 +339,62 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
         }
     }
 
+    // Turn the selected page by data degrees, clockwise is positive.
+    // A page turned on its side is joined or unjoined by its new shape
+    // the same way pages are when a file is opened, see joinAll
+    handlers.List["rotatePage"] = func(data string) {
+        d, err := strconv.Atoi(data)
+        if err != nil {
+            return
+        }
+        pi := m.PageIndex
+        p := &m.Pages[pi]
+        p.SetRotation(p.Rotation + d)
+        if d%180 != 0 {
+            if p.Width >= p.Height {
+                p.Span = model.DOUBLE
+            } else {
+                p.Span = model.SINGLE
+            }
+        }
+        m.NewSpreads()
+        m.SpreadIndex = m.PageToSpread(pi)
+        m.PageIndex = pi
+        m.RefreshSpreads()
+        m.StoreLayout()
+    }
+
+    handlers.List["toggleCrop"] = func(data string) {
+        m.CropMode = !m.CropMode
+    }
+
+    handlers.List["toggleMatchHeights"] = func(data string) {
+        m.MatchHeights = !m.MatchHeights
+    }
+
+    handlers.List["toggleTrimGutter"] = func(data string) {
+        m.TrimGutter = !m.TrimGutter
+    }
+
+    // Set the selected page's crop, percentages left,top,right,bottom,
+    // or go back to the automatic crop when there's no data. Setting
+    // one turns cropping on, so the user sees what they did
+    handlers.List["setCrop"] = func(data string) {
+        p := &m.Pages[m.PageIndex]
+        if data == "" {
+            p.Crop = nil
+        } else {
+            c, err := util.ParseCrop(data)
+            if err != nil {
+                fmt.Printf("Warning %s\n", err)
+                return
+            }
+            p.Crop = &c
+        }
+        m.CropMode = true
+        m.StoreLayout()
+    }
+
     // Hide the currently selected page
     handlers.List["hidePage"] = func(data string) {
         // Note current SpreadIndex
@@ -285,6 +451,11 @@ func NewMessageHandlers(m *model.Model, u *ui.UI) *MessageHandlerList {
         m.NewSpreads()
     }
 
+    // Pages decoded in the background are ready to show
+    handlers.List["pagesDecoded"] = func(data string) {
+        m.FinishLoads()
+    }
+
     handlers.List["render"] = func(data string) {
         // noop render always gets called after cmd
     }
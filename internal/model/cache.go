@@ -0,0 +1,159 @@
+package model
+
+import (
+    "sort"
+
+    "github.com/mftb0/cbxv/internal/util"
+)
+
+// How many spreads either side of the current one are loaded ahead of
+// time, as far as the cache's budget goes. Ahead is the way the reader
+// is heading
+const (
+    PREFETCH_AHEAD  = 4
+    PREFETCH_BEHIND = 2
+)
+
+/*
+ * Loaded pages are a cache with a budget in bytes of decoded image,
+ * see Settings.CacheSize. The spreads round the current one are loaded
+ * as far as the budget goes, the current one whatever it costs. Pages
+ * that have been seen stay loaded too, while there's room, so paging
+ * back is free, and when there isn't the ones furthest from the current
+ * spread go first, the least recently seen of those first.
+ */
+type CacheStats struct {
+    Pages     int
+    Bytes     int64
+    Budget    int64
+    Hits      int
+    Misses    int
+    Evictions int
+}
+
+// Bytes of the page's decoded images, or an estimate of what they will
+// be once it's loaded
+func (p *Page) decodedSize() int64 {
+    if p.Image == nil {
+        return int64(p.Width) * int64(p.Height) * 4
+    }
+    n := int64(p.Image.GetByteLength())
+    if p.cropped != nil {
+        n += int64(p.cropped.GetByteLength())
+    }
+    return n
+}
+
+func (m *Model) CacheStats() CacheStats {
+    s := m.cacheStats
+    s.Budget = m.Settings.CacheSize
+    for i := range m.Pages {
+        if m.Pages[i].Loaded {
+            s.Pages++
+            s.Bytes += m.Pages[i].decodedSize()
+        }
+    }
+    return s
+}
+
+// Works out which pages should be loaded round the current spread,
+// asks for the ones that aren't and unloads what doesn't fit
+func (m *Model) refreshCache() {
+    if len(m.Spreads) == 0 {
+        return
+    }
+    budget := m.Settings.CacheSize
+    m.cacheTick++
+
+    ahead := 1
+    if m.SpreadIndex < m.lastSpread {
+        ahead = -1
+    }
+    m.lastSpread = m.SpreadIndex
+    order := []int{m.SpreadIndex}
+    for d := 1; d <= PREFETCH_AHEAD; d++ {
+        order = append(order, m.SpreadIndex+d*ahead)
+    }
+    for d := 1; d <= PREFETCH_BEHIND; d++ {
+        order = append(order, m.SpreadIndex-d*ahead)
+    }
+
+    for _, p := range m.Spreads[m.SpreadIndex].Pages {
+        p.lastUsed = m.cacheTick
+        if p.Loaded {
+            m.cacheStats.Hits++
+        } else {
+            m.cacheStats.Misses++
+        }
+    }
+
+    // Nearest first, until the budget's spent
+    wanted := make(map[*Page]bool)
+    var pages []*Page
+    var size int64
+    for n, i := range order {
+        if i < 0 || i >= len(m.Spreads) {
+            continue
+        }
+        var s int64
+        for _, p := range m.Spreads[i].Pages {
+            s += p.decodedSize()
+        }
+        if n > 0 && size+s > budget {
+            break
+        }
+        size += s
+        for _, p := range m.Spreads[i].Pages {
+            wanted[p] = true
+            pages = append(pages, p)
+        }
+    }
+    m.loader.request(pages)
+
+    // Everything else that's loaded stays while it fits
+    dist := make(map[*Page]int)
+    for i := range m.Spreads {
+        d := i - m.SpreadIndex
+        if d < 0 {
+            d = -d
+        }
+        for _, p := range m.Spreads[i].Pages {
+            dist[p] = d
+        }
+    }
+    var rest []*Page
+    for i := range m.Pages {
+        p := &m.Pages[i]
+        if p.Loaded && !wanted[p] {
+            rest = append(rest, p)
+            size += p.decodedSize()
+        }
+    }
+
+    // Hidden pages aren't in any spread, they go before anything else
+    far := func(p *Page) int {
+        d, ok := dist[p]
+        if !ok {
+            return len(m.Spreads)
+        }
+        return d
+    }
+    sort.Slice(rest, func(a, b int) bool {
+        if far(rest[a]) != far(rest[b]) {
+            return far(rest[a]) > far(rest[b])
+        }
+        return rest[a].lastUsed < rest[b].lastUsed
+    })
+    for _, p := range rest {
+        if size <= budget {
+            break
+        }
+        size -= p.decodedSize()
+        p.Unload()
+        m.cacheStats.Evictions++
+    }
+
+    s := m.CacheStats()
+    util.Log("cache: %d pages, %d of %d MiB, %d hits, %d misses, %d evicted\n",
+        s.Pages, s.Bytes>>20, s.Budget>>20, s.Hits, s.Misses, s.Evictions)
+}
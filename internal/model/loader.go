@@ -0,0 +1,202 @@
+package model
+
+import (
+    "errors"
+    "fmt"
+    "image"
+    "sync"
+
+    "github.com/mftb0/cbxv/internal/util"
+)
+
+// Pages decoded at once
+const LOAD_WORKERS = 2
+
+/*
+ * Pages are read and decoded by LOAD_WORKERS goroutines into plain go
+ * images, so turning the page never waits on a decode. When there are
+ * some ready the model is sent a "pagesDecoded" and FinishLoads copies
+ * them into pixbufs, the one part that has to be on the ui thread.
+ *
+ * RefreshSpreads hands over the pages it wants in the order it wants
+ * them, which replaces whatever was still waiting, so flicking through
+ * a book doesn't leave a queue of pages nobody is looking at any more.
+ * Closing the file starts a new generation and anything decoded for
+ * the old one is thrown away.
+ */
+type loader struct {
+    mu      sync.Mutex
+    cond    *sync.Cond
+    queue   []loadJob
+    done    []loadResult
+    gen     int
+    send    util.Messenger
+    // Pages queued or being decoded, only touched on the ui thread
+    pending map[*Page]bool
+}
+
+type loadJob struct {
+    page     *Page
+    source   util.PageSource
+    name     string
+    rotation int
+    gen      int
+}
+
+type loadResult struct {
+    loadJob
+    img  *image.NRGBA
+    crop util.Crop
+    err  error
+}
+
+func newLoader(send util.Messenger) *loader {
+    l := &loader{send: send, pending: make(map[*Page]bool)}
+    l.cond = sync.NewCond(&l.mu)
+    for i := 0; i < LOAD_WORKERS; i++ {
+        go l.work()
+    }
+    return l
+}
+
+func (l *loader) work() {
+    for {
+        l.mu.Lock()
+        for len(l.queue) == 0 {
+            l.cond.Wait()
+        }
+        j := l.queue[0]
+        l.queue = l.queue[1:]
+        l.mu.Unlock()
+
+        r := loadResult{loadJob: j}
+        b, err := j.source.ReadEntry(j.name)
+        if err == nil {
+            r.img, r.crop, err = util.DecodePage(b, j.rotation)
+        }
+        r.err = err
+
+        l.mu.Lock()
+        if j.gen != l.gen {
+            l.mu.Unlock()
+            continue
+        }
+        l.done = append(l.done, r)
+        first := len(l.done) == 1
+        l.mu.Unlock()
+
+        // Anything that's done before FinishLoads gets to it goes
+        // along with these
+        if first {
+            l.send(util.Message{TypeName: "pagesDecoded"})
+        }
+    }
+}
+
+// Replaces what's waiting with pages, in order, leaving out the ones
+// that are loaded or already being decoded
+func (l *loader) request(pages []*Page) {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+
+    queued := make(map[*Page]bool, len(l.queue))
+    for _, j := range l.queue {
+        queued[j.page] = true
+        delete(l.pending, j.page)
+    }
+    l.queue = l.queue[:0]
+    for _, p := range pages {
+        if p.Loaded || (l.pending[p] && !queued[p]) {
+            continue
+        }
+        l.pending[p] = true
+        l.queue = append(l.queue, loadJob{page: p, source: p.Source, name: p.FilePath,
+            rotation: p.Rotation, gen: l.gen})
+    }
+    l.cond.Broadcast()
+}
+
+// Forgets everything, for when the file is closed
+func (l *loader) reset() {
+    l.mu.Lock()
+    l.gen++
+    l.queue = nil
+    l.done = nil
+    l.mu.Unlock()
+    l.pending = make(map[*Page]bool)
+}
+
+// Takes what's been decoded
+func (l *loader) take() []loadResult {
+    l.mu.Lock()
+    defer l.mu.Unlock()
+    d := l.done
+    l.done = nil
+    return d
+}
+
+// Puts the pages the workers have decoded into the model, must be
+// called from the ui thread
+func (m *Model) FinishLoads() {
+    again, respread := false, false
+    var problems []PageProblem
+    for _, r := range m.loader.take() {
+        p := r.page
+        delete(m.loader.pending, p)
+        if p.Loaded {
+            continue
+        }
+        // Turned while it was being decoded, it's asked for again
+        if p.Rotation != r.rotation {
+            again = true
+            continue
+        }
+        broken := p.Broken
+        err := finishLoad(r)
+        if err != nil && !broken {
+            problems = append(problems, PageProblem{p.FilePath, err.Error()})
+        }
+        if p.settleGuess() {
+            respread = true
+        }
+    }
+    // A page that was measured by loading it may not be joined the way
+    // it was guessed
+    if respread {
+        m.NewSpreads()
+        m.SpreadIndex = m.PageToSpread(m.PageIndex)
+        again = true
+    }
+    if again {
+        m.RefreshSpreads()
+    }
+    m.reportProblems(problems)
+}
+
+// Puts one decoded page into the model, returns what broke it, if
+// it's broken
+func finishLoad(r loadResult) error {
+    p := r.page
+    // Go can't read it, gdk might. Anything else that went wrong
+    // would only go wrong again
+    if errors.Is(r.err, util.ErrNoDecoder) {
+        return p.Load()
+    }
+    if r.err != nil {
+        fmt.Printf("Warning unable to load file %s\n", r.err)
+        p.loadBroken()
+        return r.err
+    }
+    f, err := util.ImgNewFromImage(r.img)
+    if err != nil {
+        fmt.Printf("Warning unable to load file %s\n", err)
+        p.loadBroken()
+        return err
+    }
+    if p.AutoCrop == nil {
+        c := r.crop
+        p.AutoCrop = &c
+    }
+    p.setImage(f)
+    return nil
+}
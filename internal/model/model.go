@@ -2,9 +2,11 @@ package model
 
 import (
     "encoding/json"
+    "errors"
     "fmt"
-    "math"
+    "io/fs"
     "os"
+    "path"
     "runtime/debug"
     "sort"
 
@@ -17,7 +19,9 @@ type Model struct {
     SendMessage    util.Messenger
     FilePath       string
     TmpDir         string
+    Source         util.PageSource
     Hash           string
+    ComicInfo      *util.ComicInfo
     Bookmarks      *BookmarkList
     ImgPaths       []string
     Pages          []Page
@@ -26,6 +30,12 @@ type Model struct {
     SpreadIndex    int
     Direction      Direction
     LayoutMode     LayoutMode
+    CropMode       bool
+    MatchHeights   bool
+    TrimGutter     bool
+    FitMode        FitMode
+    NoUpscale      bool
+    ScaleFilter    util.ScaleFilter
     SeriesList     []string
     SeriesIndex    int
     BrowseDir      string
@@ -35,6 +45,17 @@ type Model struct {
     Loading        bool
     ProgramName    string
     ProgramVersion string
+    Settings       util.Settings
+    NameEncoding   util.NameEncoding
+    Problems       []PageProblem
+    problemsShown  bool
+    probes         []pageProbe
+    loader         *loader
+    lastSpread     int
+    cacheTick      int
+    cacheStats     CacheStats
+    password       string
+    remember       bool
 }
 
 func NewModel(md ProgramMetadata, messenger util.Messenger) *Model {
@@ -43,6 +64,15 @@ func NewModel(md ProgramMetadata, messenger util.Messenger) *Model {
     m.ProgramVersion = md.Version
     m.SendMessage = messenger
     m.BrowseDir, _ = os.Getwd()
+    m.loader = newLoader(messenger)
+
+    // A broken settings file shouldn't stop anyone reading
+    s, err := util.ReadSettings()
+    if err != nil {
+        fmt.Printf("Warning unable to read settings, using defaults %s\n", err)
+    }
+    m.Settings = s
+    m.ScaleFilter = s.Filter
     return m
 }
 
@@ -61,13 +91,6 @@ const (
     RTL
 )
 
-// Maximum to load into the model
-// Currently confusing because at init the units are pages
-// Later it's spreads (so frequently double the number of pages
-const (
-    MAX_LOAD = 8
-)
-
 type ResultCode int
 
 const (
@@ -75,9 +98,37 @@ const (
     ERR
 )
 
+// Problems are pages that couldn't be read, they don't stop a
+// cbx opening, they're shown as broken pages
 type Result struct {
-    Code        ResultCode `json:"code"`
-    Description string     `json:"description"`
+    Code        ResultCode    `json:"code"`
+    Description string        `json:"description"`
+    Problems    []PageProblem `json:"problems,omitempty"`
+}
+
+type PageProblem struct {
+    FilePath string `json:"filePath"`
+    Error    string `json:"error"`
+}
+
+// Sent when the cbx being opened is encrypted, Wrong when the
+// password tried didn't work
+type PasswordRequest struct {
+    FilePath string `json:"filePath"`
+    Wrong    bool   `json:"wrong"`
+}
+
+// The user's answer to a PasswordRequest
+type PasswordResponse struct {
+    Password string `json:"password"`
+    Remember bool   `json:"remember"`
+}
+
+// What checking a page while opening found out about it
+type pageProbe struct {
+    width  int
+    height int
+    err    error
 }
 
 // Mark a place in the model by keeping track of an index in the pages slice
@@ -107,7 +158,7 @@ type BookmarkList struct {
 func NewBookmarkList(filePath string) *BookmarkList {
     b := BookmarkList{}
     m := BookmarkListModel{
-        FormatVersion: "0.1",
+        FormatVersion: "0.2",
     }
     c := ComicData{}
     c.Hash = ""
@@ -180,65 +231,318 @@ func (l *BookmarkList) Load(hash string) {
             fmt.Printf("e:%s\n", err)
         }
         l.Model = m
+
+        // Lists migrated from md5 keys still name the md5
+        l.Model.Comic.Hash = hash
     }
 }
 
+// Prior to 0.2 PageIndex referred to the byte ordered list of page
+// paths, idxs maps those indexes to current ones. It's also how they
+// follow their pages when the pages are put in a new order
+func (l *BookmarkList) migrate(idxs []int) {
+    bkmks := make([]Bookmark, 0, len(l.Model.Bookmarks))
+    for _, b := range l.Model.Bookmarks {
+        if b.PageIndex < 0 || b.PageIndex >= len(idxs) {
+            continue
+        }
+        b.PageIndex = idxs[b.PageIndex]
+        bkmks = append(bkmks, b)
+    }
+    sort.Slice(bkmks, func(i, j int) bool {
+        return bkmks[i].PageIndex < bkmks[j].PageIndex
+    })
+    l.Model.Bookmarks = bkmks
+    l.Model.FormatVersion = "0.2"
+    l.Store()
+}
+
 // A page in this case is generally analogous to an image
 // They are grouped on Spreads
+// FilePath is the name of the page's entry in its Source
+// Broken pages couldn't be read, their Image is a placeholder saying so
+// Rotation is how far clockwise the user turned the page, 0, 90, 180 or
+// 270, Width, Height and Image are all of the turned page
+// AutoCrop is worked out from the image the first time it's loaded and
+// kept in the layout, Crop is the user's, when they've set one
+// The last cropped image is kept, see DisplayImage, and when the page
+// was last on screen, see refreshCache
+// Pages that weren't measured while opening have a guessed size until
+// they're loaded, see NewPages
 type Page struct {
-    FilePath string      `json:"filePath"`
-    Width    int         `json:"width"`
-    Height   int         `json:"height"`
-    Span     int         `json:"span"`
-    Hidden   bool        `json:"hidden"`
-    Loaded   bool        `json:"loaded"`
-    Image    *util.Img   `json:"-"`
+    FilePath string          `json:"filePath"`
+    Width    int             `json:"width"`
+    Height   int             `json:"height"`
+    Span     int             `json:"span"`
+    Hidden   bool            `json:"hidden"`
+    Loaded   bool            `json:"loaded"`
+    Rotation int             `json:"rotation,omitempty"`
+    AutoCrop *util.Crop      `json:"autoCrop,omitempty"`
+    Crop     *util.Crop      `json:"crop,omitempty"`
+    Broken   bool            `json:"-"`
+    Source   util.PageSource `json:"-"`
+    Image    *util.Img       `json:"-"`
+    cropped  *util.Img
+    cropOf   *util.Img
+    cropBy   util.Crop
+    lastUsed int
+    guessed  bool
 }
 
-func (p *Page) Load() {
+// Returns what broke the page, if it's broken
+func (p *Page) Load() error {
     // Must be called from ui event dispatch thread or
     // it will leak. 
-    f, err := util.ImgNewFromFile(p.FilePath)
-    if err != nil {
-        fmt.Printf("Warning unable to load file %s\n", err)
-        return
+    b, err := p.Source.ReadEntry(p.FilePath)
+    if err == nil {
+        var f *util.Img
+        f, err = util.ImgNewFromBytes(b)
+        if err == nil && p.Rotation != 0 {
+            f, err = util.ImgRotate(f, p.Rotation)
+        }
+        if err == nil {
+            if p.AutoCrop == nil {
+                c := util.ImgContentBounds(f)
+                p.AutoCrop = &c
+            }
+            p.setImage(f)
+            return nil
+        }
     }
+    fmt.Printf("Warning unable to load file %s\n", err)
+    p.loadBroken()
+    return err
+}
+
+func (p *Page) setImage(f *util.Img) {
     p.Image = f
     p.Width = f.GetWidth()
     p.Height = f.GetHeight()
+    p.Broken = false
+    p.Loaded = true
+}
+
+// A broken page keeps its place in the spreads and shows that it's
+// broken, rather than leaving a black hole. The placeholder is drawn
+// smaller than the page, but the same shape
+func (p *Page) loadBroken() {
+    p.Broken = true
+    if p.Width <= 0 || p.Height <= 0 {
+        p.Width = util.BROKEN_PAGE_W
+        p.Height = util.BROKEN_PAGE_H
+    }
+    w := util.BROKEN_PAGE_W
+    h := p.Height * w / p.Width
+    if h > util.BROKEN_PAGE_H {
+        h = util.BROKEN_PAGE_H
+        w = p.Width * h / p.Height
+    }
+
+    msg := fmt.Sprintf("Unable to read %s", path.Base(p.FilePath))
+    f, err := util.ImgNewBrokenPage(w, h, msg)
+    if err != nil {
+        fmt.Printf("Warning unable to create broken page %s\n", err)
+        return
+    }
+    p.Image = f
     p.Loaded = true
 }
 
-func (p *Page) LoadMeta() {
-    _, w, h, err := util.ImgGetFileInfo(p.FilePath)
+// A page that wasn't measured before it was loaded is joined now, the
+// way joinAll would have. True when that changed its span
+func (p *Page) settleGuess() bool {
+    if !p.guessed || !p.Loaded {
+        return false
+    }
+    p.guessed = false
+    if p.Broken {
+        return false
+    }
+    span := SINGLE
+    if p.Width >= p.Height {
+        span = DOUBLE
+    }
+    if p.Span == span {
+        return false
+    }
+    p.Span = span
+    return true
+}
+
+// Turns the page to rotation degrees clockwise of how it's stored, a
+// loaded page's image is turned along with it
+func (p *Page) SetRotation(rotation int) {
+    rotation = ((rotation % 360) + 360) % 360
+    delta := (rotation - p.Rotation + 360) % 360
+    if delta == 0 {
+        return
+    }
+    p.Rotation = rotation
+    p.Width, p.Height = rotatedSize(p.Width, p.Height, delta)
+    if p.AutoCrop != nil {
+        c := p.AutoCrop.Rotate(delta)
+        p.AutoCrop = &c
+    }
+    if p.Crop != nil {
+        c := p.Crop.Rotate(delta)
+        p.Crop = &c
+    }
+    if p.Image == nil {
+        return
+    }
+    if p.Broken {
+        p.loadBroken()
+        return
+    }
+    f, err := util.ImgRotate(p.Image, delta)
     if err != nil {
-        fmt.Printf("Warning unable to load metadata for file %s\n", err)
+        // It'll be turned when it's loaded again
+        fmt.Printf("Warning unable to rotate page %s\n", err)
+        p.Image = nil
+        p.Loaded = false
         return
     }
-    p.Width = w
-    p.Height = h
+    p.Image = f
+}
+
+// The user's crop if they set one, otherwise the automatic one, which
+// is nothing until the page has been loaded
+func (p *Page) CropBox() util.Crop {
+    if p.Crop != nil {
+        return *p.Crop
+    }
+    if p.AutoCrop != nil {
+        return *p.AutoCrop
+    }
+    return util.Crop{}
+}
+
+// The image as it's drawn, cropped when crop is set. Gutter is the side
+// of the page that's against the other page of a spread, if it's to be
+// trimmed, that side is cropped even when the rest isn't
+func (p *Page) DisplayImage(crop bool, gutter Gutter) (*util.Img, error) {
+    if p.Broken || p.Image == nil {
+        return p.Image, nil
+    }
+    var c util.Crop
+    b := p.CropBox()
+    if crop {
+        c = b
+    }
+    switch gutter {
+    case GUTTER_LEFT:
+        c.Left = b.Left
+    case GUTTER_RIGHT:
+        c.Right = b.Right
+    }
+    if c.IsZero() {
+        return p.Image, nil
+    }
+    // The same crop of the same image is the same pixbuf every time, so
+    // it's cropped once and the scaled copies of it can be kept
+    if p.cropped != nil && p.cropOf == p.Image && p.cropBy == c {
+        return p.cropped, nil
+    }
+    img, err := util.ImgCrop(p.Image, c)
+    if err != nil {
+        return nil, err
+    }
+    p.cropped, p.cropOf, p.cropBy = img, p.Image, c
+    return img, nil
+}
+
+func (p *Page) Unload() {
+    p.Image = nil
+    p.cropped = nil
+    p.cropOf = nil
     p.Loaded = false
 }
 
-// Creates pgs slice and loads it
+func rotatedSize(w int, h int, rotation int) (int, int) {
+    if rotation == 90 || rotation == 270 {
+        return h, w
+    }
+    return w, h
+}
+
+// Creates pgs slice, using what was found out about each page while
+// opening, see probePages. Pages it didn't measure, because go can't
+// parse them or the cbx wasn't probed, get the size of a page near them
+// until they're loaded
 func (m *Model) NewPages() {
 
     pages := make([]Page, len(m.ImgPaths))
 
     for i := range m.ImgPaths {
         pages[i].FilePath = m.ImgPaths[i]
+        pages[i].Source = m.Source
         pages[i].Span = SINGLE
         pages[i].Loaded = false
-        if i < MAX_LOAD {
-            pages[i].Load()
-        } else {
-            pages[i].LoadMeta()
+        if i < len(m.probes) {
+            pages[i].Width = m.probes[i].width
+            pages[i].Height = m.probes[i].height
+            pages[i].Broken = m.probes[i].err != nil
         }
     }
+    m.probes = nil
+
+    for i := range pages {
+        pages[i].guessed = !pages[i].Broken && pages[i].Width == 0
+    }
+    sizeUnknownPages(pages)
 
+    // The images themselves are loaded in the background, see
+    // RefreshSpreads
     m.Pages = pages
 }
 
+// Broken and unmeasured pages take the size of the page before them, or
+// after them for the first pages, so spreads still look right
+func sizeUnknownPages(pages []Page) {
+    var w, h int
+    for i := range pages {
+        if pages[i].Width > 0 && pages[i].Height > 0 {
+            w, h = pages[i].Width, pages[i].Height
+            break
+        }
+    }
+    if w == 0 {
+        w, h = util.BROKEN_PAGE_W, util.BROKEN_PAGE_H
+    }
+
+    for i := range pages {
+        p := &pages[i]
+        if p.Width > 0 && p.Height > 0 {
+            w, h = p.Width, p.Height
+            continue
+        }
+        if p.Broken || p.guessed {
+            p.Width, p.Height = w, h
+        }
+    }
+}
+
+// Check every page can be read before anything is shown, so broken
+// ones can be reported all at once. Runs off the ui thread, so it
+// only reads, see NewPages. Rar and 7z would have to decompress the
+// lot to do it, so they aren't, their broken pages are reported as
+// they're loaded, see reportProblems
+func (m *Model) probePages() []PageProblem {
+    if !util.RandomAccess(m.Source) {
+        return nil
+    }
+    var problems []PageProblem
+    m.probes = make([]pageProbe, len(m.ImgPaths))
+    for i, name := range m.ImgPaths {
+        w, h, err := util.ProbeEntry(m.Source, name)
+        m.probes[i] = pageProbe{w, h, err}
+        if err != nil {
+            problems = append(problems, PageProblem{name, err.Error()})
+        }
+    }
+    return problems
+}
+
 // How a page is oriented
 type Span int
 
@@ -247,6 +551,15 @@ const (
     DOUBLE
 )
 
+// Which side of a page is the gutter, when it's trimmed
+type Gutter int
+
+const (
+    GUTTER_NONE = iota
+    GUTTER_LEFT
+    GUTTER_RIGHT
+)
+
 // A Spread is an element of a layout
 // It's essentially the pages you can
 // see at a given time
@@ -373,12 +686,32 @@ const (
     LONG_STRIP
 )
 
+// Fit mode determines how big spreads are drawn
+// FIT_WINDOW = the whole spread fits the window
+// FIT_WIDTH = as wide as the window, scroll up and down
+// FIT_HEIGHT = as tall as the window, scroll left and right
+// FIT_ORIGINAL = 1 image pixel to 1 screen pixel
+type FitMode int
+
+const (
+    FIT_WINDOW = iota
+    FIT_WIDTH
+    FIT_HEIGHT
+    FIT_ORIGINAL
+)
+
 type Layout struct {
     FormatVersion string     `json:"formatVersion"`
     Comic         ComicData  `json:"comic"`
     Direction     Direction  `json:"direction"`
     Mode          LayoutMode `json:"mode"`
+    Fit           FitMode    `json:"fit,omitempty"`
+    NoUpscale     bool       `json:"noUpscale,omitempty"`
     Pages         []Page     `json:"pages"`
+
+    // Page names depend on it, so it's read before the rest, see
+    // OpenCbxFile
+    NameEncoding util.NameEncoding `json:"nameEncoding,omitempty"`
 }
 
 func (m *Model) LoadSeriesList() {
@@ -402,10 +735,13 @@ func (m *Model) LoadSeriesList() {
  *
  * The first phase "Opening" the cbx is asynchronous:
  * hash created
- * tmpDir created
- * cbx file opened
- * cbx file extracted
+ * tmpDir named
+ * cbx file opened as a PageSource
+ * pages listed and ordered
+ * Nothing is extracted, pages are read from the source as they're loaded
  * Errors during this phase are considered critical, and stop the process 
+ * Except an encrypted cbx, which asks the ui for a password and waits for
+ * it to try again, see sendPasswordReqMsg
  * The ui is up and alive, but the user can't navigate until this phase signals
  * completion either success or failure. If the result is success LoadCbx is invoked,
  * see below
@@ -414,34 +750,94 @@ func (m *Model) LoadSeriesList() {
 func (m *Model) OpenCbxFile() {
     m.SendMessage(util.Message{TypeName: "render"})
 
-    hash, err := util.HashFile(m.FilePath)
+    var hash string
+    var err error
+    isDir := util.IsDir(m.FilePath)
+    if isDir {
+        hash, err = util.HashDir(m.FilePath)
+    } else {
+        hash, err = util.Fingerprint(m.FilePath)
+    }
     if err != nil {
         m.sendOpenFileResMsg(-1, fmt.Sprintf("Error opening file; %s", err))
         return
     }
     m.Hash = hash
 
-    td, err := util.CreateTmpDir()
-    if err != nil {
-        m.sendOpenFileResMsg(-11, fmt.Sprintf("Error creating tmp dir; %s", err))
-        return
+    // Trying again with a password keeps the tmp dir of the first try
+    if m.TmpDir == "" {
+        td, err := util.CreateTmpDir()
+        if err != nil {
+            m.sendOpenFileResMsg(-11, fmt.Sprintf("Error creating tmp dir; %s", err))
+            return
+        }
+        m.TmpDir = td
+    }
+
+    // Until the user's been asked, try whatever password was remembered
+    password := m.password
+    remembered := false
+    if password == "" && !isDir {
+        password, err = util.ReadPassword(m.Hash)
+        if err != nil {
+            fmt.Printf("Warning unable to read remembered password %s\n", err)
+        }
+        remembered = password != ""
+    }
+
+    if lo := m.loadLayout(m.Hash, m.Direction); lo != nil {
+        m.NameEncoding = lo.NameEncoding
     }
-    m.TmpDir = td
 
-    ip, err := util.GetImagePaths(m.FilePath, m.TmpDir)
+    opts := util.OpenOptions{
+        TmpDir:       m.TmpDir,
+        Limits:       m.Settings.Limits,
+        Password:     password,
+        NameEncoding: m.NameEncoding,
+    }
+    src, err := util.OpenPageSource(m.FilePath, opts)
     if err != nil {
-        m.sendOpenFileResMsg(-21, fmt.Sprintf("Error extracting cbx file; %s", err))
+        var oe *util.OpenError
+        if errors.Is(err, util.ErrPasswordRequired) || errors.Is(err, util.ErrBadPassword) {
+            if remembered {
+                util.ForgetPassword(m.Hash)
+            }
+            m.sendPasswordReqMsg(errors.Is(err, util.ErrBadPassword))
+        } else if errors.As(err, &oe) && oe.Format == util.FORMAT_UNKNOWN {
+            m.sendOpenFileResMsg(-22, fmt.Sprintf("Error opening cbx file; %s", err))
+        } else if errors.Is(err, util.ErrLimitExceeded) {
+            m.sendOpenFileResMsg(-23, fmt.Sprintf("Refusing to open cbx file; %s", err))
+        } else {
+            m.sendOpenFileResMsg(-21, fmt.Sprintf("Error opening cbx file; %s", err))
+        }
         return
     }
-    m.ImgPaths = ip
+    if m.remember && m.password != "" {
+        err = util.WritePassword(m.Hash, m.password)
+        if err != nil {
+            fmt.Printf("Warning unable to remember password %s\n", err)
+        }
+    }
+    m.Source = src
+    ip := util.PageEntries(src)
 
-    m.sendOpenFileResMsg(0, "Success")
+    // ComicInfo.xml is optional, but a broken one is worth a warning
+    ci, err := util.ReadComicInfo(src)
+    if err != nil && !errors.Is(err, fs.ErrNotExist) {
+        fmt.Printf("Warning unable to read ComicInfo.xml %s\n", err)
+    }
+    m.ComicInfo = ci
+    m.ImgPaths = util.OrderPages(ip, ci)
+
+    problems := m.probePages()
+    m.sendOpenFileResMsg(0, "Success", problems...)
 }
 
 /*
  * The second phase of the "loading" process is the actual loading and 
  * its synchronous. We have a lot of stuff to load:
- * individual pages 
+ * individual pages, which are only asked for here, their images are
+ * decoded in the background, see loader
  * page metadata 
  * layout
  * bookmarks
@@ -463,23 +859,90 @@ func (m *Model) LoadCbxFile() {
     m.SpreadIndex = 0
     m.PageIndex = 0
 
+    // Metadata shipped with the comic is applied first so that
+    // anything the user saved in the layout wins over it
+    dir := m.Direction
     m.joinAll()
-    lo := m.loadLayout(m.Hash)
+    if m.ComicInfo != nil {
+        dir = m.applyComicInfo(m.ComicInfo, dir)
+    }
+    lo := m.loadLayout(m.Hash, dir)
     if lo != nil {
-        m.applyLayout(lo)
+        dir = m.applyLayout(lo)
     }
+    m.setDirection(dir)
 
     m.NewSpreads()
 
-    m.loadBookmarks()
+    m.loadBookmarks(lo)
+    m.RefreshSpreads()
 
     m.SendMessage(util.Message{TypeName: "render"})
 }
 
+/*
+ * Page names change with the encoding and layouts match pages by name,
+ * so before the file is opened again with enc the pages are renamed,
+ * going by the entry each one was read from, and stored that way when
+ * it's closed. New names can sort differently, so bookmarks are moved
+ * to where their pages will be.
+ */
+func (m *Model) SetNameEncoding(enc util.NameEncoding) {
+    m.NameEncoding = enc
+    if m.Source == nil || m.Pages == nil {
+        return
+    }
+    names := util.RenamedEntries(m.Source, enc)
+    if len(names) == 0 {
+        return
+    }
+    rename := func(n string) string {
+        if r, ok := names[n]; ok {
+            return r
+        }
+        return n
+    }
+
+    paths := make([]string, len(m.ImgPaths))
+    for i := range m.ImgPaths {
+        paths[i] = rename(m.ImgPaths[i])
+    }
+    order := make(map[string]int)
+    for i, n := range util.OrderPages(paths, m.ComicInfo) {
+        order[n] = i
+    }
+    idxs := make([]int, len(m.Pages))
+    for i := range m.Pages {
+        m.Pages[i].FilePath = rename(m.Pages[i].FilePath)
+        idxs[i] = order[m.Pages[i].FilePath]
+    }
+    if m.Bookmarks != nil {
+        m.Bookmarks.migrate(idxs)
+    }
+}
+
 func (m *Model) CloseCbxFile() {
     m.StoreLayout()
-    os.RemoveAll(m.TmpDir)
+    if m.Source != nil {
+        m.Source.Close()
+        m.Source = nil
+    }
+    if m.TmpDir != "" {
+        os.RemoveAll(m.TmpDir)
+    }
+    m.TmpDir = ""
+    m.password = ""
+    m.remember = false
+    m.loader.reset()
+    m.lastSpread = 0
+    m.cacheStats = CacheStats{}
+    m.NameEncoding = util.NAME_ENCODING_AUTO
+    m.Problems = nil
+    m.problemsShown = false
+    m.FitMode = FIT_WINDOW
+    m.NoUpscale = false
     m.Hash = ""
+    m.ComicInfo = nil
     m.ImgPaths = nil
     m.Pages = nil
     m.Spreads = nil
@@ -504,42 +967,27 @@ func (m *Model) SpreadLoaded(spreadIndex int) bool {
     return true
  }
 
-// Iterate over spreads and load/unload pages as needed
-// based on the current spread index
+// Load and unload pages round the current spread, within the
+// cache's budget, see refreshCache. Loading is in the background
 func (m *Model) RefreshSpreads() {
     if m.LayoutMode != LONG_STRIP {
-        start := int(math.Max(0, float64(m.SpreadIndex-(MAX_LOAD/2)+1)))
-        end := int(math.Min(float64(m.SpreadIndex+(MAX_LOAD/2)-1), float64(len(m.Spreads)-1)))
-
-        // iterate over all spreads
-        // load/unload pgs as needed
-        for i := range m.Spreads {
-            spread := m.Spreads[i]
-            if i < start || i > end {
-                for j := range spread.Pages {
-                    if spread.Pages[j].Loaded {
-                        spread.Pages[j].Image = nil
-                        spread.Pages[j].Loaded = false
-                    }
-                }
-            } else {
-                for j := range spread.Pages {
-                    if !spread.Pages[j].Loaded {
-                        spread.Pages[j].Load()
-                    }
-                }
-            }
-        }
-
+        m.refreshCache()
         m.printLoaded()
     } else {
         // load all pages
+        var problems []PageProblem
         for i := range m.Pages {
             page := &m.Pages[i]
             if !page.Loaded {
-                page.Load()
+                broken := page.Broken
+                err := page.Load()
+                if err != nil && !broken {
+                    problems = append(problems, PageProblem{page.FilePath, err.Error()})
+                }
+                page.settleGuess()
             }
         }
+        m.reportProblems(problems)
     }
 }
 
@@ -585,9 +1033,14 @@ func (m *Model) PageToSpread(n int) int {
     return  0
 }
 
+// Nothing's stored for a file that never opened, (a cancelled password
+// prompt say), it would replace the layout with an empty one
 func (m *Model) StoreLayout() error {
+    if m.Hash == "" || m.Pages == nil {
+        return nil
+    }
     layout := Layout{
-        FormatVersion: "0.2",
+        FormatVersion: "0.3",
     }
     c := ComicData{}
     c.Hash = m.Hash
@@ -595,6 +1048,10 @@ func (m *Model) StoreLayout() error {
     layout.Comic = c
     layout.Direction = m.Direction
     layout.Mode = m.LayoutMode
+    layout.Fit = m.FitMode
+    layout.NoUpscale = m.NoUpscale
+    layout.NameEncoding = m.NameEncoding
+
     layout.Pages = m.Pages
 
     data, err := json.Marshal(layout)
@@ -609,21 +1066,35 @@ func (m *Model) StoreLayout() error {
     return nil
 }
 
-func (m *Model) loadBookmarks() {
+// Bookmarks before 0.2 were indexes in the old page order, which an
+// old layout's pages are in, so they follow the layout's pages when
+// there's one of those, see layoutPageIndexes. Those of a pdf are
+// dropped, see util.IsPdfSource
+func (m *Model) loadBookmarks(lo *Layout) {
     m.Bookmarks = NewBookmarkList(m.FilePath)
     m.Bookmarks.Load(m.Hash)
+    if m.Bookmarks.Model.FormatVersion == "0.1" {
+        if util.IsPdfSource(m.Source) {
+            fmt.Printf("Warning dropping bookmarks saved before 0.2 for pdf %s\n", m.FilePath)
+            m.Bookmarks.migrate(nil)
+        } else if lo != nil && lo.legacy() {
+            m.Bookmarks.migrate(m.layoutPageIndexes(lo))
+        } else {
+            m.Bookmarks.migrate(util.LegacyPageOrder(m.pageNames()))
+        }
+    }
     m.SendMessage(util.Message{TypeName: "render"})
 }
 
-func (m *Model) loadLayout(hash string) *Layout {
+func (m *Model) loadLayout(hash string, dir Direction) *Layout {
     data, _ := util.ReadLayout(hash)
 
     if data != nil {
         var lo Layout
-        // default Direction to whatever it's currently 
-        // set too, because it was added in 0.2 and we 
+        // default Direction to whatever it would be without 
+        // a layout, because it was added in 0.2 and we 
         // want to preserve existing behavior
-        lo.Direction = m.Direction
+        lo.Direction = dir
         err := json.Unmarshal([]byte(*data), &lo)
         if err != nil {
             fmt.Printf("e:%s\n", err)
@@ -643,24 +1114,137 @@ func (m *Model) joinAll() {
     }
 }
 
-func (m *Model) applyLayout(layout *Layout) {
-    if m.Direction != layout.Direction {
-        m.SendMessage(util.Message{TypeName: "toggleDirection"})
-    }
-
+// Returns the direction the layout asks for
+func (m *Model) applyLayout(layout *Layout) Direction {
+    idxs := m.layoutPageIndexes(layout)
     for i := range layout.Pages {
+        if i >= len(idxs) || idxs[i] < 0 {
+            continue
+        }
         p := layout.Pages[i]
-        mp := m.Pages[i]
+        mp := m.Pages[idxs[i]]
         mp.Span = p.Span
+        mp.guessed = false
         mp.Hidden = p.Hidden
-        m.Pages[i] = mp
+        mp.SetRotation(p.Rotation)
+        if p.AutoCrop != nil {
+            mp.AutoCrop = p.AutoCrop
+        }
+        mp.Crop = p.Crop
+        m.Pages[idxs[i]] = mp
     }
+    m.FitMode = layout.Fit
+    m.NoUpscale = layout.NoUpscale
+    return layout.Direction
+}
+
+// Maps each page of a stored layout to the index of the same image in
+// m.Pages, -1 if it's gone. Since 0.3 pages are matched by their entry
+// name in the cbx. Older layouts saved the path each page was
+// extracted to, which has the entry name in it, see
+// util.MatchLegacyPages, except for pdfs, see util.IsPdfSource
+func (m *Model) layoutPageIndexes(layout *Layout) []int {
+    idxs := make([]int, len(layout.Pages))
+    if layout.legacy() && util.IsPdfSource(m.Source) {
+        fmt.Printf("Warning dropping pages of a layout saved before 0.3 for pdf %s\n", m.FilePath)
+        for i := range idxs {
+            idxs[i] = -1
+        }
+        return idxs
+    }
+    if layout.legacy() {
+        saved := make([]string, len(layout.Pages))
+        for i := range layout.Pages {
+            saved[i] = layout.Pages[i].FilePath
+        }
+        return util.MatchLegacyPages(m.pageNames(), saved)
+    }
+
+    names := make(map[string]int)
+    for i := range m.Pages {
+        names[m.Pages[i].FilePath] = i
+    }
+    for i := range layout.Pages {
+        idx, ok := names[layout.Pages[i].FilePath]
+        if !ok {
+            idx = -1
+        }
+        idxs[i] = idx
+    }
+    return idxs
+}
+
+// Saved before pages were known by their entry names, see
+// util.MatchLegacyPages
+func (lo *Layout) legacy() bool {
+    return lo.FormatVersion == "0.1" || lo.FormatVersion == "0.2"
+}
+
+func (m *Model) pageNames() []string {
+    names := make([]string, len(m.Pages))
+    for i := range m.Pages {
+        names[i] = m.Pages[i].FilePath
+    }
+    return names
+}
+
+// Returns the direction the ComicInfo asks for, dir if it doesn't care
+func (m *Model) applyComicInfo(ci *util.ComicInfo, dir Direction) Direction {
+    idxs := make(map[string]int)
+    for i := range m.Pages {
+        idxs[m.Pages[i].FilePath] = i
+    }
+
+    for _, cp := range ci.Pages {
+        i, ok := idxs[cp.Path]
+        if !ok {
+            continue
+        }
+        p := &m.Pages[i]
+        if cp.IsDoublePage() {
+            p.Span = DOUBLE
+        }
+        if cp.IsHidden() {
+            p.Hidden = true
+        }
+    }
+
+    if ci.RightToLeft() {
+        return RTL
+    }
+    return dir
+}
+
+// Direction is owned by the toggleDirection handler, because it also
+// swaps the page turning handlers, so changes go through it
+func (m *Model) setDirection(dir Direction) {
+    if m.Direction != dir {
+        m.SendMessage(util.Message{TypeName: "toggleDirection"})
+    }
+}
+
+// Try opening the cbx again with a password the user entered, see
+// PasswordRequest
+func (m *Model) SetPassword(password string, remember bool) {
+    m.password = password
+    m.remember = remember
+}
+
+// Ask the ui for a password, it answers with SetPassword and another
+// OpenCbxFile, or gives up and closes the file
+func (m *Model) sendPasswordReqMsg(wrong bool) {
+    buf, err := json.Marshal(PasswordRequest{m.FilePath, wrong})
+    if err != nil {
+        m.sendOpenFileResMsg(-24, fmt.Sprintf("Error asking for password; %s", err))
+        return
+    }
+    m.SendMessage(util.Message{TypeName: "passwordRequired", Data: string(buf)})
 }
 
 // Make sure we always send a result message, no errors allowed
-func (m *Model) sendOpenFileResMsg(code ResultCode, description string) {
+func (m *Model) sendOpenFileResMsg(code ResultCode, description string, problems ...PageProblem) {
     var d string
-    r := Result{code, description}
+    r := Result{code, description, problems}
     buf, err := json.Marshal(r)
     if err != nil {
         d = fmt.Sprintf("{\"code\":%d,\"result\":\"%s\"}", r.Code, r.Description)
@@ -671,6 +1255,29 @@ func (m *Model) sendOpenFileResMsg(code ResultCode, description string) {
     m.SendMessage(util.Message{TypeName: "openFileResult", Data: d})
 }
 
+// Pages that turned out to be broken when they were loaded, rather
+// than when the cbx was opened. Only the first ones found are sent,
+// the rest just add to the count, see AddProblems
+func (m *Model) reportProblems(problems []PageProblem) {
+    if m.AddProblems(problems) {
+        m.SendMessage(util.Message{TypeName: "pageProblems"})
+    }
+}
+
+// Adds to the broken pages of the open cbx. True the first time there
+// are any, the user's told about them once per cbx, not once a page
+func (m *Model) AddProblems(problems []PageProblem) bool {
+    if len(problems) == 0 {
+        return false
+    }
+    m.Problems = append(m.Problems, problems...)
+    if m.problemsShown {
+        return false
+    }
+    m.problemsShown = true
+    return true
+}
+
 // dbg
 func (m *Model) checkSpreads() {
     c := 0
@@ -115,6 +115,86 @@ func NewCommands(m *model.Model, u *UI) *CommandList {
 			u.SendMessage(util.Message{TypeName: "setLayoutModeLongStrip"})
 		}))
 
+	AddCommand(cmds, NewCommand("setFitModeWindow", "Fit Mode Window",
+		[]uint{gdk.KEY_4},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "setFitModeWindow"})
+		}))
+
+	AddCommand(cmds, NewCommand("setFitModeWidth", "Fit Mode Width",
+		[]uint{gdk.KEY_5},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "setFitModeWidth"})
+		}))
+
+	AddCommand(cmds, NewCommand("setFitModeHeight", "Fit Mode Height",
+		[]uint{gdk.KEY_6},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "setFitModeHeight"})
+		}))
+
+	AddCommand(cmds, NewCommand("setFitModeOriginal", "Fit Mode Original",
+		[]uint{gdk.KEY_7},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "setFitModeOriginal"})
+		}))
+
+	AddCommand(cmds, NewCommand("toggleNoUpscale", "Toggle No Upscale",
+		[]uint{gdk.KEY_u},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "toggleNoUpscale"})
+		}))
+
+	AddCommand(cmds, NewCommand("cycleScaleFilter", "Cycle Scale Filter",
+		[]uint{gdk.KEY_i},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "cycleScaleFilter"})
+		}))
+
+	// Panning only moves the view, so it doesn't go through the model
+	AddCommand(cmds, NewCommand("panUp", "Pan Up",
+		[]uint{gdk.KEY_W, gdk.KEY_Page_Up},
+		func(args ...any) {
+			u.View.Pan(0, -PAN_STEP)
+		}))
+
+	AddCommand(cmds, NewCommand("panDown", "Pan Down",
+		[]uint{gdk.KEY_S, gdk.KEY_Page_Down},
+		func(args ...any) {
+			u.View.Pan(0, PAN_STEP)
+		}))
+
+	AddCommand(cmds, NewCommand("panLeft", "Pan Left",
+		[]uint{gdk.KEY_A},
+		func(args ...any) {
+			u.View.Pan(-PAN_STEP, 0)
+		}))
+
+	AddCommand(cmds, NewCommand("panRight", "Pan Right",
+		[]uint{gdk.KEY_D},
+		func(args ...any) {
+			u.View.Pan(PAN_STEP, 0)
+		}))
+
+	// Zoom is view state like pan, it isn't kept in the model either
+	AddCommand(cmds, NewCommand("zoomIn", "Zoom In",
+		[]uint{gdk.KEY_plus, gdk.KEY_equal, gdk.KEY_KP_Add},
+		func(args ...any) {
+			u.View.Zoom(ZOOM_STEP)
+		}))
+
+	AddCommand(cmds, NewCommand("zoomOut", "Zoom Out",
+		[]uint{gdk.KEY_underscore, gdk.KEY_KP_Subtract},
+		func(args ...any) {
+			u.View.Zoom(1 / ZOOM_STEP)
+		}))
+
+	AddCommand(cmds, NewCommand("zoomReset", "Reset Zoom",
+		[]uint{gdk.KEY_0, gdk.KEY_KP_0},
+		func(args ...any) {
+			u.View.ResetZoom()
+		}))
+
 	AddCommand(cmds, NewCommand("toggleDirection", "Toggle Read Mode",
 		[]uint{gdk.KEY_grave},
 		func(args ...any) {
@@ -143,13 +223,19 @@ func NewCommands(m *model.Model, u *UI) *CommandList {
                     "_Cancel", gtk.RESPONSE_CANCEL)
                 defer dlg.Destroy()
 
+                // A directory of images can be opened too, but the open
+                // button just navigates into directories
+                dlg.AddButton("Open _Folder", gtk.RESPONSE_APPLY)
+
                 dlg.SetCurrentFolder(m.BrowseDir)
                 fltr, _ := gtk.FileFilterNew()
                 fltr.AddPattern("*.cbz")
                 fltr.AddPattern("*.cbr")
+                fltr.AddPattern("*.rar")
                 fltr.AddPattern("*.cb7")
                 fltr.AddPattern("*.cbt")
                 fltr.AddPattern("*.pdf")
+                fltr.AddPattern("*.epub")
                 fltr.SetName("cbx files")
                 dlg.AddFilter(fltr)
                 fltr, _ = gtk.FileFilterNew()
@@ -162,6 +248,15 @@ func NewCommands(m *model.Model, u *UI) *CommandList {
                     f := dlg.GetFilename()
                     m := &util.Message{TypeName: "openFile", Data: f}
                     u.SendMessage(*m)
+                } else if gtk.ResponseType(output) == gtk.RESPONSE_APPLY {
+                    // Open the selected directory, if none is selected
+                    // the one being browsed
+                    f := dlg.GetFilename()
+                    if f == "" || !util.IsDir(f) {
+                        f, _ = dlg.GetCurrentFolder()
+                    }
+                    m := &util.Message{TypeName: "openFile", Data: f}
+                    u.SendMessage(*m)
                 }
             }
 		}))
@@ -207,6 +302,18 @@ func NewCommands(m *model.Model, u *UI) *CommandList {
 			}
 		}))
 
+	AddCommand(cmds, NewCommand("setNameEncoding", "Set Name Encoding",
+		[]uint{gdk.KEY_N},
+		func(args ...any) {
+			if m.Pages == nil {
+				return
+			}
+			enc, ok := u.PromptNameEncoding(m.NameEncoding)
+			if ok && enc != m.NameEncoding {
+				u.SendMessage(util.Message{TypeName: "setNameEncoding", Data: string(enc)})
+			}
+		}))
+
 	AddCommand(cmds, NewCommand("toggleBookmark", "Toggle Bookmark",
 		[]uint{gdk.KEY_space},
 		func(args ...any) {
@@ -219,6 +326,58 @@ func NewCommands(m *model.Model, u *UI) *CommandList {
 			u.SendMessage(util.Message{TypeName: "toggleJoin"})
 		}))
 
+	AddCommand(cmds, NewCommand("rotatePageLeft", "Rotate Page Left",
+		[]uint{gdk.KEY_bracketleft},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "rotatePage", Data: "-90"})
+		}))
+
+	AddCommand(cmds, NewCommand("rotatePageRight", "Rotate Page Right",
+		[]uint{gdk.KEY_bracketright},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "rotatePage", Data: "90"})
+		}))
+
+	AddCommand(cmds, NewCommand("toggleCrop", "Toggle Crop",
+		[]uint{gdk.KEY_x},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "toggleCrop"})
+		}))
+
+	AddCommand(cmds, NewCommand("editCrop", "Edit Crop",
+		[]uint{gdk.KEY_X},
+		func(args ...any) {
+			if m.Pages == nil {
+				return
+			}
+			// Not until it's been decoded
+			p := &m.Pages[m.PageIndex]
+			if p.Broken || !p.Loaded {
+				return
+			}
+			c, auto, ok := u.PromptCrop(p.Image, p.CropBox())
+			if !ok {
+				return
+			}
+			if auto {
+				u.SendMessage(util.Message{TypeName: "setCrop"})
+			} else {
+				u.SendMessage(util.Message{TypeName: "setCrop", Data: c.String()})
+			}
+		}))
+
+	AddCommand(cmds, NewCommand("toggleMatchHeights", "Toggle Match Heights",
+		[]uint{gdk.KEY_m},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "toggleMatchHeights"})
+		}))
+
+	AddCommand(cmds, NewCommand("toggleTrimGutter", "Toggle Trim Gutter",
+		[]uint{gdk.KEY_g},
+		func(args ...any) {
+			u.SendMessage(util.Message{TypeName: "toggleTrimGutter"})
+		}))
+
 	AddCommand(cmds, NewCommand("hidePage", "Hide Page",
 		[]uint{gdk.KEY_minus},
 		func(args ...any) {
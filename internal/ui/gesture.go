@@ -0,0 +1,38 @@
+package ui
+
+// #cgo pkg-config: gtk+-3.0
+// #include <gtk/gtk.h>
+import "C"
+
+import (
+	"unsafe"
+
+	"github.com/gotk3/gotk3/glib"
+	"github.com/gotk3/gotk3/gtk"
+)
+
+// Gotk3 doesn't wrap GtkGestureZoom, which is how gtk reports pinches
+// on touchscreens and touchpads. Its scale-changed signal carries how
+// far the fingers have spread since the pinch began, 1 to start with
+type GestureZoom struct {
+	*glib.Object
+}
+
+func GestureZoomNew(w gtk.IWidget) *GestureZoom {
+	c := C.gtk_gesture_zoom_new((*C.GtkWidget)(unsafe.Pointer(w.ToWidget().Native())))
+	if c == nil {
+		return nil
+	}
+	return &GestureZoom{glib.Take(unsafe.Pointer(c))}
+}
+
+func (g *GestureZoom) native() *C.GtkGesture {
+	return (*C.GtkGesture)(unsafe.Pointer(g.Native()))
+}
+
+// Where the middle of the pinch is, in the widget's coordinates
+func (g *GestureZoom) GetBoundingBoxCenter() (x float64, y float64, ok bool) {
+	var cx, cy C.gdouble
+	ok = C.gtk_gesture_get_bounding_box_center(g.native(), &cx, &cy) != 0
+	return float64(cx), float64(cy), ok
+}
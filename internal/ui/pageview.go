@@ -21,6 +21,61 @@ const (
 
 const TICK = 3000
 
+// How far the pan commands move a spread that's bigger than the
+// window, as a fraction of the window, and how far the mouse wheel does
+const PAN_STEP = 0.25
+const PAN_SCROLL_STEP = 0.1
+
+// Further than this and a click is a drag
+const DRAG_THRESHOLD = 8
+
+// Each zoom step, and how far in and out zoom goes, relative to the
+// spread's size in the fit mode
+const ZOOM_STEP = 1.25
+const ZOOM_MIN = 0.25
+const ZOOM_MAX = 8
+
+// The loupe's magnification, relative to how big the page is drawn, and
+// its radius, in pixels. The wheel steps both while it's shown
+const LOUPE_MAG = 2
+const LOUPE_MAG_MIN = 2
+const LOUPE_MAG_MAX = 4
+const LOUPE_MAG_STEP = 0.5
+const LOUPE_RADIUS = 100
+const LOUPE_RADIUS_MIN = 50
+const LOUPE_RADIUS_MAX = 300
+const LOUPE_RADIUS_STEP = 25
+
+// How far a spread that's bigger than the window is scrolled, from its
+// top left, and how far it can be, which is 0 when it fits. Zoom is how
+// much bigger than its fit mode makes it the spread is drawn. Origin is
+// where its top left was last drawn, which is what zooming is anchored
+// by. It all goes back to the start whenever a different spread is shown
+type Pan struct {
+    X, Y             int
+    MaxX, MaxY       int
+    Zoom             float64
+    originX, originY int
+    spread           *model.Spread
+    // What was drawn where, unscaled, for the loupe
+    shown            []shownImage
+}
+
+// An image as it was drawn, at x,y and w by h on the canvas
+type shownImage struct {
+    img        *gdk.Pixbuf
+    x, y, w, h int
+}
+
+// While the right button is held the loupe is shown at x,y, magnifying
+// from the pages' full size images rather than what's on screen
+type Loupe struct {
+    X, Y   float64
+    Mag    float64
+    Radius float64
+    active bool
+}
+
 type PageView struct {
     ui                   *UI
     hud                  *gtk.Overlay
@@ -30,11 +85,22 @@ type PageView struct {
     keyPressSignalHandle *glib.SignalHandle
     hdrControl           *PageViewHdrControl
     navControl           *PageViewNavControl
+    pan                  Pan
+    pressX, pressY       float64
+    dragged              bool
+    pinch                *GestureZoom
+    pinchZoom            float64
+    loupe                Loupe
+    scaled               *ScaleCache
 }
 
 func NewPageView(m *model.Model, u *UI, messenger util.Messenger) View {
     v := &PageView{}
     v.ui = u
+    v.loupe = Loupe{Mag: LOUPE_MAG, Radius: LOUPE_RADIUS}
+    v.scaled = NewScaleCache(func() {
+        v.canvas.QueueDraw()
+    })
 
     v.hud = v.newHUD(m, u)
 
@@ -140,10 +206,19 @@ func (v *PageView) initRenderer(m *model.Model) {
 
         spread := m.Spreads[m.SpreadIndex]
         if m.SpreadLoaded(m.SpreadIndex) {
+            if v.pan.spread != spread {
+                v.resetPan(m, spread)
+            }
+            v.pan.shown = nil
+            v.scaled.Begin(m.ScaleFilter)
             if m.LayoutMode == model.TWO_PAGE {
-                renderTwoPageSpread(cr, canvas, newTwoPageSpread(m, spread))
+                renderTwoPageSpread(cr, canvas, newTwoPageSpread(m, spread), &v.pan, v.scaled)
             } else if m.LayoutMode == model.ONE_PAGE {
-                renderOnePageSpread(cr, canvas, newOnePageSpread(spread.Pages[0]))
+                renderOnePageSpread(cr, canvas, newOnePageSpread(m, spread.Pages[0]), &v.pan, v.scaled)
+            }
+            v.scaled.End()
+            if v.loupe.active {
+                renderLoupe(cr, v.pan.shown, &v.loupe)
             }
         }
         return true
@@ -151,6 +226,10 @@ func (v *PageView) initRenderer(m *model.Model) {
 
     v.canvas.AddEvents(4)
     v.canvas.AddEvents(int(gdk.BUTTON_PRESS_MASK))
+    v.canvas.AddEvents(int(gdk.BUTTON_RELEASE_MASK))
+    v.canvas.AddEvents(int(gdk.BUTTON1_MOTION_MASK))
+    v.canvas.AddEvents(int(gdk.BUTTON3_MOTION_MASK))
+    v.canvas.AddEvents(int(gdk.SCROLL_MASK))
     v.canvas.Connect("event", func(canvas *gtk.DrawingArea, event *gdk.Event) bool {
         if v.hudHidden {
             //reset the hud hiding
@@ -163,7 +242,118 @@ func (v *PageView) initRenderer(m *model.Model) {
         return false
     })
 
+    // Clicks turn the page, unless the spread is bigger than the window
+    // and the mouse is dragged, which moves it around. Holding the right
+    // button shows the loupe instead
     v.canvas.Connect("button-press-event", func(canvas *gtk.DrawingArea, event *gdk.Event) bool {
+        e := &gdk.EventButton{Event: event}
+        if e.Button() == gdk.BUTTON_SECONDARY {
+            v.loupe.active = true
+            v.loupe.X, v.loupe.Y = e.X(), e.Y()
+            v.canvas.QueueDraw()
+            return true
+        }
+        v.pressX, v.pressY = e.X(), e.Y()
+        v.dragged = false
+        return true
+    })
+
+    v.canvas.Connect("motion-notify-event", func(canvas *gtk.DrawingArea, event *gdk.Event) bool {
+        e := gdk.EventMotionNewFromEvent(event)
+        x, y := e.MotionVal()
+        if v.loupe.active {
+            v.loupe.X, v.loupe.Y = x, y
+            v.canvas.QueueDraw()
+            return true
+        }
+        if !v.dragged && math.Abs(x-v.pressX) < DRAG_THRESHOLD &&
+            math.Abs(y-v.pressY) < DRAG_THRESHOLD {
+            return true
+        }
+        if v.pan.MaxX == 0 && v.pan.MaxY == 0 {
+            return true
+        }
+        v.dragged = true
+        v.panBy(int(v.pressX-x), int(v.pressY-y))
+        v.pressX, v.pressY = x, y
+        return true
+    })
+
+    // Ctrl+wheel zooms at the pointer, the wheel alone pans. While the
+    // loupe's shown they change its size and magnification instead
+    v.canvas.Connect("scroll-event", func(canvas *gtk.DrawingArea, event *gdk.Event) bool {
+        e := gdk.EventScrollNewFromEvent(event)
+        if v.loupe.active {
+            step := 0.0
+            switch e.Direction() {
+            case gdk.SCROLL_UP:
+                step = 1
+            case gdk.SCROLL_DOWN:
+                step = -1
+            }
+            if e.State()&gdk.CONTROL_MASK != 0 {
+                v.loupe.Radius = math.Max(LOUPE_RADIUS_MIN,
+                    math.Min(LOUPE_RADIUS_MAX, v.loupe.Radius+step*LOUPE_RADIUS_STEP))
+            } else {
+                v.loupe.Mag = math.Max(LOUPE_MAG_MIN,
+                    math.Min(LOUPE_MAG_MAX, v.loupe.Mag+step*LOUPE_MAG_STEP))
+            }
+            v.canvas.QueueDraw()
+            return true
+        }
+        if e.State()&gdk.CONTROL_MASK != 0 {
+            switch e.Direction() {
+            case gdk.SCROLL_UP:
+                v.zoomAt(ZOOM_STEP, e.X(), e.Y())
+            case gdk.SCROLL_DOWN:
+                v.zoomAt(1/ZOOM_STEP, e.X(), e.Y())
+            }
+            return true
+        }
+        switch e.Direction() {
+        case gdk.SCROLL_UP:
+            v.Pan(0, -PAN_SCROLL_STEP)
+        case gdk.SCROLL_DOWN:
+            v.Pan(0, PAN_SCROLL_STEP)
+        case gdk.SCROLL_LEFT:
+            v.Pan(-PAN_SCROLL_STEP, 0)
+        case gdk.SCROLL_RIGHT:
+            v.Pan(PAN_SCROLL_STEP, 0)
+        }
+        return true
+    })
+
+    // Pinches zoom at the middle of the fingers, scale is relative to
+    // when the pinch began
+    v.pinch = GestureZoomNew(v.canvas)
+    if v.pinch != nil {
+        v.pinch.Connect("begin", func() {
+            v.pinchZoom = v.pan.Zoom
+        })
+        v.pinch.Connect("scale-changed", func(_ any, scale float64) {
+            x, y, ok := v.pinch.GetBoundingBoxCenter()
+            if !ok || v.pan.Zoom == 0 {
+                return
+            }
+            v.zoomAt(v.pinchZoom*scale/v.pan.Zoom, x, y)
+        })
+    }
+
+    // While zoomed in clicks don't turn the page, it's too easy to do
+    // by accident while looking around
+    v.canvas.Connect("button-release-event", func(canvas *gtk.DrawingArea, event *gdk.Event) bool {
+        if (&gdk.EventButton{Event: event}).Button() == gdk.BUTTON_SECONDARY {
+            v.loupe.active = false
+            v.canvas.QueueDraw()
+            return true
+        }
+        if v.dragged {
+            v.dragged = false
+            return true
+        }
+        if v.pan.Zoom != 1 {
+            return true
+        }
         r := false
         w := v.hud.GetAllocatedWidth()
         half := float64(w / 2)
@@ -184,24 +374,96 @@ func (v *PageView) initRenderer(m *model.Model) {
     })
 }
 
+// Moves the spread by a fraction of the window, when it's bigger than
+// the window
+func (v *PageView) Pan(dx float64, dy float64) {
+    v.panBy(int(dx*float64(v.canvas.GetAllocatedWidth())),
+        int(dy*float64(v.canvas.GetAllocatedHeight())))
+}
+
+func (v *PageView) panBy(dx int, dy int) {
+    x := clampPan(v.pan.X+dx, v.pan.MaxX)
+    y := clampPan(v.pan.Y+dy, v.pan.MaxY)
+    if x != v.pan.X || y != v.pan.Y {
+        v.pan.X, v.pan.Y = x, y
+        v.canvas.QueueDraw()
+    }
+}
+
+// Zooms by factor, anchored at the middle of the window
+func (v *PageView) Zoom(factor float64) {
+    v.zoomAt(factor, float64(v.canvas.GetAllocatedWidth())/2,
+        float64(v.canvas.GetAllocatedHeight())/2)
+}
+
+func (v *PageView) ResetZoom() {
+    if v.pan.Zoom != 1 {
+        v.pan.Zoom = 1
+        v.canvas.QueueDraw()
+    }
+}
+
+// Zooms by factor keeping whatever's under x,y on the canvas there
+func (v *PageView) zoomAt(factor float64, x float64, y float64) {
+    if v.pan.Zoom == 0 {
+        return
+    }
+    z := math.Max(ZOOM_MIN, math.Min(ZOOM_MAX, v.pan.Zoom*factor))
+    if z == v.pan.Zoom {
+        return
+    }
+    factor = z / v.pan.Zoom
+    v.pan.Zoom = z
+    v.pan.X = int((x-float64(v.pan.originX))*factor - x)
+    v.pan.Y = int((y-float64(v.pan.originY))*factor - y)
+    v.canvas.QueueDraw()
+}
+
+// A new spread starts at the top, on the side it's read from
+func (v *PageView) resetPan(m *model.Model, spread *model.Spread) {
+    v.pan = Pan{spread: spread, Zoom: 1}
+    if m.Direction == model.RTL {
+        v.pan.X = math.MaxInt32
+    }
+}
+
+func clampPan(p int, max int) int {
+    if p > max {
+        p = max
+    }
+    if p < 0 {
+        p = 0
+    }
+    return p
+}
+
 type PagePosition int
 
 type OnePageSpread struct {
-    page   *model.Page
+    page      *model.Page
+    crop      bool
+    fit       model.FitMode
+    noUpscale bool
 }
 
-func newOnePageSpread(page *model.Page) *OnePageSpread {
-    return &OnePageSpread{page}
+func newOnePageSpread(m *model.Model, page *model.Page) *OnePageSpread {
+    return &OnePageSpread{page, m.CropMode, m.FitMode, m.NoUpscale}
 }
 
 type TwoPageSpread struct {
-    leftPage  *model.Page
-    rightPage *model.Page
+    leftPage     *model.Page
+    rightPage    *model.Page
+    crop         bool
+    matchHeights bool
+    trimGutter   bool
+    fit          model.FitMode
+    noUpscale    bool
 }
 
 // Create a two pg spread accounting for direction
 func newTwoPageSpread(m *model.Model, spread *model.Spread) *TwoPageSpread {
-    s := &TwoPageSpread{}
+    s := &TwoPageSpread{crop: m.CropMode, matchHeights: m.MatchHeights, trimGutter: m.TrimGutter,
+        fit: m.FitMode, noUpscale: m.NoUpscale}
     if m.Direction == model.LTR {
         s.leftPage = spread.Pages[0]
         if len(spread.Pages) > 1 {
@@ -220,18 +482,48 @@ func newTwoPageSpread(m *model.Model, spread *model.Spread) *TwoPageSpread {
 }
 
 func scalePixbufToFit(p *gdk.Pixbuf, w int, h int) (*gdk.Pixbuf, error) {
-    cW := float64(w)
-    cH := float64(h)
-    pW := float64(p.GetWidth())
-    pH := float64(p.GetHeight())
-    var r *gdk.Pixbuf
-    var err error
-    scale := math.Min(cW/pW, cH/pH)
-    r, err = p.ScaleSimple(int(pW*scale), int(pH*scale), gdk.INTERP_BILINEAR)
+    return scalePixbuf(p, fitScale(p, w, h, false))
+}
+
+// What p has to be scaled by to fit w by h, never more than 1 when
+// noUpscale is set
+func fitScale(p *gdk.Pixbuf, w int, h int, noUpscale bool) float64 {
+    scale := math.Min(float64(w)/float64(p.GetWidth()), float64(h)/float64(p.GetHeight()))
+    if noUpscale && scale > 1 {
+        scale = 1
+    }
+    return scale
+}
+
+func scalePixbuf(p *gdk.Pixbuf, scale float64) (*gdk.Pixbuf, error) {
+    w := int(float64(p.GetWidth()) * scale)
+    h := int(float64(p.GetHeight()) * scale)
+    return scalePixbufToSize(p, w, h)
+}
+
+func scalePixbufToSize(p *gdk.Pixbuf, w int, h int) (*gdk.Pixbuf, error) {
+    if w < 1 {
+        w = 1
+    }
+    if h < 1 {
+        h = 1
+    }
+    if w == p.GetWidth() && h == p.GetHeight() {
+        return p, nil
+    }
+    return p.ScaleSimple(w, h, gdk.INTERP_BILINEAR)
+}
+
+// The page's image, cropped if crop is set, and the same scaled to fit
+// w by h
+func scalePageToFit(page *model.Page, crop bool, gutter model.Gutter, noUpscale bool, w int, h int, sc *ScaleCache) (*gdk.Pixbuf, *gdk.Pixbuf, error) {
+    img, err := page.DisplayImage(crop, gutter)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
-    return r, nil
+    scale := fitScale(img, w, h, noUpscale)
+    p, err := sc.Scale(img, int(float64(img.GetWidth())*scale), int(float64(img.GetHeight())*scale))
+    return img, p, err
 }
 
 func positionPixbuf(canvas *gtk.DrawingArea, p *gdk.Pixbuf, pos PagePosition) (x, y int) {
@@ -261,69 +553,237 @@ func renderPixbuf(cr *cairo.Context, p *gdk.Pixbuf, x, y int) {
     cr.Paint()
 }
 
-func renderOnePageSpread(cr *cairo.Context, canvas *gtk.DrawingArea, s *OnePageSpread) error {
+func renderOnePageSpread(cr *cairo.Context, canvas *gtk.DrawingArea, s *OnePageSpread, pan *Pan, sc *ScaleCache) error {
     if s.page.Loaded == false {
         return fmt.Errorf("Image required by spread not loaded")
     }
 
-    cW := canvas.GetAllocatedWidth()
-    cH := canvas.GetAllocatedHeight()
-    p, err := scalePixbufToFit(s.page.Image, cW, cH)
+    img, err := s.page.DisplayImage(s.crop, model.GUTTER_NONE)
     if err != nil {
         return err
     }
-
-    x, y := positionPixbuf(canvas, p, ALIGN_CENTER)
-    renderPixbuf(cr, p, x, y)
-    return nil
+    return renderScaledSpread(cr, canvas, []*gdk.Pixbuf{img}, false, s.fit, s.noUpscale, pan, sc)
 }
 
 // direction (rtl or ltr) has already been accounted for
 // so left and right here are literal
-func renderTwoPageSpread(cr *cairo.Context, canvas *gtk.DrawingArea, s *TwoPageSpread) error {
+func renderTwoPageSpread(cr *cairo.Context, canvas *gtk.DrawingArea, s *TwoPageSpread, pan *Pan, sc *ScaleCache) error {
     if s.leftPage.Loaded == false {
         return fmt.Errorf("Image required by spread not loaded")
     }
 
     var x, y, cW, cH int
-    var lp, rp *gdk.Pixbuf
+    var li, ri, lp, rp *gdk.Pixbuf
     var err error
-    if s.rightPage != nil {
+    var lg, rg model.Gutter = model.GUTTER_NONE, model.GUTTER_NONE
+    if s.trimGutter {
+        lg, rg = model.GUTTER_RIGHT, model.GUTTER_LEFT
+    }
+    if s.rightPage != nil && (s.matchHeights || s.fit != model.FIT_WINDOW || pan.Zoom != 1) {
+        return renderSideBySide(cr, canvas, s, lg, rg, pan, sc)
+    } else if s.rightPage != nil {
+        pan.X, pan.Y, pan.MaxX, pan.MaxY = 0, 0, 0, 0
+
         //put the left pg on the left, right-aligned
         cW = canvas.GetAllocatedWidth() / 2
         cH = canvas.GetAllocatedHeight()
-        lp, err = scalePixbufToFit(s.leftPage.Image, cW, cH)
+        li, lp, err = scalePageToFit(s.leftPage, s.crop, lg, s.noUpscale, cW, cH, sc)
         if err != nil {
             return err
         }
 
         x, y = positionPixbuf(canvas, lp, ALIGN_RIGHT)
         renderPixbuf(cr, lp, x, y)
+        pan.shown = append(pan.shown, shownImage{li, x, y, lp.GetWidth(), lp.GetHeight()})
 
         //put the right pg on the right, left-aligned
         if s.rightPage.Loaded == false {
             return fmt.Errorf("Image required by spread not loaded")
         }
 
-        rp, err = scalePixbufToFit(s.rightPage.Image, cW, cH)
+        ri, rp, err = scalePageToFit(s.rightPage, s.crop, rg, s.noUpscale, cW, cH, sc)
         if err != nil {
             return err
         } 
 
         x, y = positionPixbuf(canvas, rp, ALIGN_LEFT)
         renderPixbuf(cr, rp, x, y)
+        pan.shown = append(pan.shown, shownImage{ri, x, y, rp.GetWidth(), rp.GetHeight()})
     } else {
         //there is no right page, then center the left page
-        cW = canvas.GetAllocatedWidth()
-        cH = canvas.GetAllocatedHeight()
-        lp, err = scalePixbufToFit(s.leftPage.Image, cW, cH)
+        img, err := s.leftPage.DisplayImage(s.crop, model.GUTTER_NONE)
         if err != nil {
             return err
         }
+        return renderScaledSpread(cr, canvas, []*gdk.Pixbuf{img}, false, s.fit, s.noUpscale, pan, sc)
+    }
+    return nil
+}
 
-        x, y = positionPixbuf(canvas, lp, ALIGN_CENTER)
-        renderPixbuf(cr, lp, x, y)
+// Both pages side by side in the middle, rather than each fit to its
+// own half, which is how spreads are drawn when they're matched or
+// not fit to the window
+func renderSideBySide(cr *cairo.Context, canvas *gtk.DrawingArea, s *TwoPageSpread, lg model.Gutter, rg model.Gutter, pan *Pan, sc *ScaleCache) error {
+    if s.rightPage.Loaded == false {
+        return fmt.Errorf("Image required by spread not loaded")
+    }
+
+    li, err := s.leftPage.DisplayImage(s.crop, lg)
+    if err != nil {
+        return err
+    }
+    ri, err := s.rightPage.DisplayImage(s.crop, rg)
+    if err != nil {
+        return err
+    }
+    return renderScaledSpread(cr, canvas, []*gdk.Pixbuf{li, ri}, s.matchHeights, s.fit, s.noUpscale, pan, sc)
+}
+
+/*
+ * Draws imgs side by side as one spread, scaled together by fit and
+ * zoomed by pan. When match is set they're all made as tall as the
+ * tallest first, otherwise shorter ones are centered against it. A
+ * spread that's smaller than the window is centered in it, one that's
+ * bigger is drawn at pan, and only the part that's in the window is
+ * scaled, so zooming way in doesn't make enormous pixbufs.
+ */
+func renderScaledSpread(cr *cairo.Context, canvas *gtk.DrawingArea, imgs []*gdk.Pixbuf, match bool, fit model.FitMode, noUpscale bool, pan *Pan, sc *ScaleCache) error {
+    cW := float64(canvas.GetAllocatedWidth())
+    cH := float64(canvas.GetAllocatedHeight())
+
+    // The spread's size before it's scaled
+    ws := make([]float64, len(imgs))
+    hs := make([]float64, len(imgs))
+    var sW, sH float64
+    for i := range imgs {
+        hs[i] = float64(imgs[i].GetHeight())
+        sH = math.Max(sH, hs[i])
+    }
+    for i := range imgs {
+        ws[i] = float64(imgs[i].GetWidth())
+        if match {
+            ws[i] = ws[i] * sH / hs[i]
+            hs[i] = sH
+        }
+        sW += ws[i]
+    }
+
+    var scale float64
+    switch fit {
+    case model.FIT_WIDTH:
+        scale = cW / sW
+    case model.FIT_HEIGHT:
+        scale = cH / sH
+    case model.FIT_ORIGINAL:
+        scale = 1
+    default:
+        scale = math.Min(cW/sW, cH/sH)
+    }
+    if noUpscale && scale > 1 {
+        scale = 1
+    }
+    scale *= pan.Zoom
+
+    iws := make([]int, len(imgs))
+    w := 0
+    for i := range imgs {
+        iws[i] = max(1, int(ws[i]*scale))
+        w += iws[i]
+    }
+    h := max(1, int(sH*scale))
+
+    pan.MaxX = max(0, w-int(cW))
+    pan.MaxY = max(0, h-int(cH))
+    pan.X = clampPan(pan.X, pan.MaxX)
+    pan.Y = clampPan(pan.Y, pan.MaxY)
+
+    x := (int(cW) - w) / 2
+    if pan.MaxX > 0 {
+        x = -pan.X
+    }
+    y := (int(cH) - h) / 2
+    if pan.MaxY > 0 {
+        y = -pan.Y
+    }
+    pan.originX, pan.originY = x, y
+
+    for i := range imgs {
+        ih := max(1, int(hs[i]*scale))
+        iy := y + (h-ih)/2
+        p, px, py, err := sc.ScaleClipped(imgs[i], x, iy, iws[i], ih, int(cW), int(cH))
+        if err != nil {
+            return err
+        }
+        if p != nil {
+            renderPixbuf(cr, p, px, py)
+        }
+        pan.shown = append(pan.shown, shownImage{imgs[i], x, iy, iws[i], ih})
+        x += iws[i]
     }
     return nil
 }
 
+/*
+ * Draws the loupe, a circle round l.X,l.Y with everything in it l.Mag
+ * times bigger. Each image is scaled again from its full size, so there
+ * is detail in it that the screen doesn't have room for, and only the
+ * bit in the circle is, so it's cheap enough to do on every move.
+ */
+func renderLoupe(cr *cairo.Context, shown []shownImage, l *Loupe) {
+    r := l.Radius
+    size := int(2 * r)
+    // Top left of the loupe's box on the canvas
+    bx, by := int(l.X-r), int(l.Y-r)
+
+    cr.Save()
+    cr.NewPath()
+    cr.Arc(l.X, l.Y, r, 0, 2*math.Pi)
+    cr.Clip()
+    cr.SetSourceRGB(0, 0, 0)
+    cr.Paint()
+    for _, s := range shown {
+        // Where the image would be, magnified round the pointer,
+        // relative to the box
+        x := int(l.X+(float64(s.x)-l.X)*l.Mag) - bx
+        y := int(l.Y+(float64(s.y)-l.Y)*l.Mag) - by
+        w := int(float64(s.w) * l.Mag)
+        h := int(float64(s.h) * l.Mag)
+        p, px, py, err := scalePixbufClipped(s.img, x, y, w, h, size, size, gdk.INTERP_BILINEAR)
+        if err != nil {
+            fmt.Printf("Warning loupe %s\n", err)
+            continue
+        }
+        if p != nil {
+            renderPixbuf(cr, p, bx+px, by+py)
+        }
+    }
+    cr.Restore()
+
+    cr.NewPath()
+    cr.Arc(l.X, l.Y, r, 0, 2*math.Pi)
+    cr.SetSourceRGB(0.5, 0.5, 0.5)
+    cr.SetLineWidth(2)
+    cr.Stroke()
+}
+
+// Scales p to w by h at x,y, but only the part of it that's inside cW
+// by cH, which is returned along with where it goes. Nil if none of it
+// is inside
+func scalePixbufClipped(p *gdk.Pixbuf, x int, y int, w int, h int, cW int, cH int, interp gdk.InterpType) (*gdk.Pixbuf, int, int, error) {
+    x0, y0 := max(x, 0), max(y, 0)
+    x1, y1 := min(x+w, cW), min(y+h, cH)
+    if x1 <= x0 || y1 <= y0 {
+        return nil, 0, 0, nil
+    }
+    if x0 == x && y0 == y && x1 == x+w && y1 == y+h {
+        r, err := scalePixbufToSize(p, w, h)
+        return r, x, y, err
+    }
+    d, err := gdk.PixbufNew(p.GetColorspace(), p.GetHasAlpha(), p.GetBitsPerSample(), x1-x0, y1-y0)
+    if err != nil {
+        return nil, 0, 0, err
+    }
+    p.Scale(d, 0, 0, x1-x0, y1-y0, float64(x-x0), float64(y-y0),
+        float64(w)/float64(p.GetWidth()), float64(h)/float64(p.GetHeight()), interp)
+    return d, x0, y0, nil
+}
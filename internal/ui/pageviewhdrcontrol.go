@@ -150,6 +150,9 @@ func (c *PageViewHdrControl) Render(m *model.Model) {
         rbkmkcss, _ := c.rightBookmark.GetStyleContext()
         spread := m.Spreads[m.SpreadIndex]
         title := strings.TrimSuffix(filepath.Base(m.FilePath), filepath.Ext(m.FilePath))
+        if len(m.Problems) > 0 {
+            title = fmt.Sprintf("%s (%d broken)", title, len(m.Problems))
+        }
 
         if m.Direction == model.RTL {
             if len(spread.Pages) > 1 {
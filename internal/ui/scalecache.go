@@ -0,0 +1,168 @@
+package ui
+
+import (
+	"fmt"
+	"image"
+	"runtime"
+	"sync/atomic"
+
+	"github.com/gotk3/gotk3/gdk"
+	"github.com/gotk3/gotk3/glib"
+
+	"github.com/mftb0/cbxv/internal/util"
+)
+
+// Lanczos scales going at once, any more wait their turn
+const SCALE_JOBS = 2
+
+/*
+ * Scaled page images, kept from one draw to the next, so redraws that
+ * only change the HUD or the loupe don't scale the pages all over
+ * again. They're keyed by the image, the size it's scaled to, the
+ * filter and, when only part of it is in the window, which part.
+ * Whatever a draw doesn't use is dropped at the end of it.
+ *
+ * Lanczos downscales are done on a goroutine into a go image, the page
+ * is drawn bilinear till it's ready, then it's made into a pixbuf back
+ * on the ui thread, the only place pixbufs are made, and drawn again.
+ */
+type ScaleCache struct {
+    entries map[scaleKey]*scaledImage
+    filter  util.ScaleFilter
+    redraw  func()
+    jobs    chan struct{}
+}
+
+type scaleKey struct {
+    src    *gdk.Pixbuf
+    w, h   int
+    clip   image.Rectangle
+    filter util.ScaleFilter
+}
+
+type scaledImage struct {
+    p    *gdk.Pixbuf
+    used bool
+    // Dropped before its lanczos job got going
+    stale atomic.Bool
+}
+
+func NewScaleCache(redraw func()) *ScaleCache {
+    return &ScaleCache{
+        entries: make(map[scaleKey]*scaledImage),
+        redraw:  redraw,
+        jobs:    make(chan struct{}, SCALE_JOBS),
+    }
+}
+
+// Call before a draw, with the filter it's drawn with
+func (c *ScaleCache) Begin(filter util.ScaleFilter) {
+    c.filter = filter
+    for _, e := range c.entries {
+        e.used = false
+    }
+}
+
+// Call after a draw
+func (c *ScaleCache) End() {
+    for k, e := range c.entries {
+        if !e.used {
+            e.stale.Store(true)
+            delete(c.entries, k)
+        }
+    }
+}
+
+// p scaled to w by h
+func (c *ScaleCache) Scale(p *gdk.Pixbuf, w int, h int) (*gdk.Pixbuf, error) {
+    w, h = max(1, w), max(1, h)
+    if w == p.GetWidth() && h == p.GetHeight() {
+        return p, nil
+    }
+    k := scaleKey{src: p, w: w, h: h, filter: c.filter}
+    if e := c.entries[k]; e != nil {
+        e.used = true
+        return e.p, nil
+    }
+
+    // Lanczos is only worth the wait shrinking
+    filter := c.filter
+    if filter == util.FILTER_LANCZOS && w >= p.GetWidth() {
+        filter = util.FILTER_HYPER
+    }
+    later := filter == util.FILTER_LANCZOS
+    if later {
+        filter = util.FILTER_BILINEAR
+    }
+    q, err := util.ImgScale(p, w, h, filter)
+    if err != nil {
+        return nil, err
+    }
+    e := &scaledImage{p: q, used: true}
+    c.entries[k] = e
+    if later {
+        c.scaleLater(k, e)
+    }
+    return q, nil
+}
+
+// p scaled to w by h at x,y, but only what's inside cW by cH, see
+// scalePixbufClipped. Lanczos isn't worth it for a bit of a page, so
+// it's hyper
+func (c *ScaleCache) ScaleClipped(p *gdk.Pixbuf, x int, y int, w int, h int, cW int, cH int) (*gdk.Pixbuf, int, int, error) {
+    x0, y0 := max(x, 0), max(y, 0)
+    x1, y1 := min(x+w, cW), min(y+h, cH)
+    if x1 <= x0 || y1 <= y0 {
+        return nil, 0, 0, nil
+    }
+    if x0 == x && y0 == y && x1 == x+w && y1 == y+h {
+        q, err := c.Scale(p, w, h)
+        return q, x, y, err
+    }
+    k := scaleKey{src: p, w: w, h: h, clip: image.Rect(x0-x, y0-y, x1-x, y1-y), filter: c.filter}
+    if e := c.entries[k]; e != nil {
+        e.used = true
+        return e.p, x0, y0, nil
+    }
+
+    interp := gdk.INTERP_HYPER
+    if c.filter == util.FILTER_BILINEAR {
+        interp = gdk.INTERP_BILINEAR
+    }
+    q, px, py, err := scalePixbufClipped(p, x, y, w, h, cW, cH, interp)
+    if err != nil {
+        return nil, 0, 0, err
+    }
+    c.entries[k] = &scaledImage{p: q, used: true}
+    return q, px, py, nil
+}
+
+// Scales k's image with lanczos into e, unless e's been dropped by the
+// time it's done, then draws again. Only the pixels are scaled off the
+// ui thread, the pixbuf for them is made back on it
+func (c *ScaleCache) scaleLater(k scaleKey, e *scaledImage) {
+    src := k.src
+    pix, stride, channels := src.GetPixels(), src.GetRowstride(), src.GetNChannels()
+    w, h := src.GetWidth(), src.GetHeight()
+    go func() {
+        c.jobs <- struct{}{}
+        defer func() { <-c.jobs }()
+        if e.stale.Load() {
+            return
+        }
+        n := util.ScaleLanczos(util.PixNRGBA(pix, stride, channels, w, h), k.w, k.h)
+        runtime.KeepAlive(src)
+        glib.IdleAdd(func() {
+            if c.entries[k] != e {
+                return
+            }
+            q, err := util.ImgNewFromImage(n)
+            if err != nil {
+                fmt.Printf("Warning unable to scale page %s\n", err)
+                return
+            }
+            e.p = q
+            c.redraw()
+        })
+    }()
+}
@@ -140,6 +140,21 @@ func (v *StripView) ScrollToBottom() {
 	v.scrollbars.GetVAdjustment().SetValue(b)
 }
 
+// Scrolls by a fraction of the window
+func (v *StripView) Pan(dx float64, dy float64) {
+	h := v.scrollbars.GetHAdjustment()
+	h.SetValue(h.GetValue() + dx*h.GetPageSize())
+	a := v.scrollbars.GetVAdjustment()
+	a.SetValue(a.GetValue() + dy*a.GetPageSize())
+}
+
+// Strips are always as wide as the window, so there's no zooming
+func (v *StripView) Zoom(factor float64) {
+}
+
+func (v *StripView) ResetZoom() {
+}
+
 func (v *StripView) newHUD(m *model.Model, u *UI) *gtk.Overlay {
 	o, _ := gtk.OverlayNew()
 
@@ -185,7 +200,12 @@ func (v *StripView) renderSpreads(m *model.Model) {
 
 	for i := range m.Spreads[0].Pages {
 		page := m.Spreads[0].Pages[i]
-		p, _ := v.scalePixbufToWidth(page.Image, v.width)
+		img, err := page.DisplayImage(m.CropMode, model.GUTTER_NONE)
+		if err != nil {
+			fmt.Printf("Warning unable to crop page %s\n", err)
+			img = page.Image
+		}
+		p, _ := v.scalePixbufToWidth(img, v.width, m.NoUpscale)
 		c, _ := gtk.ImageNewFromPixbuf(p)
 		v.container.PackStart(c, true, true, 0)
 		v.scrollbars.ShowAll()
@@ -219,7 +239,7 @@ func (v *StripView) clampScale(scale float64, pW float64, pH float64) float64 {
 	return 1
 }
 
-func (v *StripView) scalePixbufToWidth(p *gdk.Pixbuf, w int) (*gdk.Pixbuf, error) {
+func (v *StripView) scalePixbufToWidth(p *gdk.Pixbuf, w int, noUpscale bool) (*gdk.Pixbuf, error) {
 	cW := float64(w)
 	pW := float64(p.GetWidth())
 	pH := float64(p.GetHeight())
@@ -227,7 +247,9 @@ func (v *StripView) scalePixbufToWidth(p *gdk.Pixbuf, w int) (*gdk.Pixbuf, error
 
 	if pW != cW {
 		scale := cW / pW
-		if scale > 1 {
+		if scale > 1 && noUpscale {
+			scale = 1
+		} else if scale > 1 {
 			scale = v.clampScale(scale, pW, pH)
 		}
 
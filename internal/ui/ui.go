@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"strings"
 
+	"github.com/gotk3/gotk3/cairo"
 	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
 	"github.com/gotk3/gotk3/gtk"
@@ -15,6 +16,9 @@ type View interface {
 	Connect(m *model.Model, u *UI)
 	Disconnect(m *model.Model, u *UI)
 	Render(m *model.Model)
+	Pan(dx float64, dy float64)
+	Zoom(factor float64)
+	ResetZoom()
 }
 
 type UI struct {
@@ -99,6 +103,191 @@ func (u *UI) DisplayErrorDlg(message string) {
     dlg.Run()
 }
 
+// Something went wrong, but not so wrong the user can't carry on
+func (u *UI) DisplayWarningDlg(message string) {
+    dlg := gtk.MessageDialogNewWithMarkup(u.MainWindow,
+        gtk.DialogFlags(gtk.DIALOG_MODAL),
+        gtk.MESSAGE_WARNING, gtk.BUTTONS_CLOSE, "Warning")
+    defer dlg.Destroy()
+
+    dlg.SetTitle("Warning")
+    dlg.SetMarkup(message)
+    css, _ := dlg.GetStyleContext()
+    css.AddClass("msg-dlg")
+
+    dlg.Run()
+}
+
+// Ask for the password to an encrypted cbx, ok is false if the user
+// cancelled. Wrong says the last one tried didn't work
+func (u *UI) PromptPassword(fileName string, wrong bool) (password string, remember bool, ok bool) {
+    dlg, err := gtk.DialogNewWithButtons("Password", u.MainWindow,
+        gtk.DialogFlags(gtk.DIALOG_MODAL),
+        []interface{}{"_Cancel", gtk.RESPONSE_CANCEL},
+        []interface{}{"_Open", gtk.RESPONSE_ACCEPT})
+    if err != nil {
+        return "", false, false
+    }
+    defer dlg.Destroy()
+    dlg.SetDefaultResponse(gtk.RESPONSE_ACCEPT)
+    css, _ := dlg.GetStyleContext()
+    css.AddClass("msg-dlg")
+
+    msg := fmt.Sprintf("%s is password protected", glib.MarkupEscapeText(fileName))
+    if wrong {
+        msg = fmt.Sprintf("<b>Wrong password</b> for %s, try again", glib.MarkupEscapeText(fileName))
+    }
+    lbl, _ := gtk.LabelNew("")
+    lbl.SetMarkup(msg)
+
+    entry, _ := gtk.EntryNew()
+    entry.SetVisibility(false)
+    entry.SetInputPurpose(gtk.INPUT_PURPOSE_PASSWORD)
+    entry.SetActivatesDefault(true)
+
+    chk, _ := gtk.CheckButtonNewWithMnemonic("_Remember password")
+
+    box, _ := dlg.GetContentArea()
+    box.SetSpacing(8)
+    box.Add(lbl)
+    box.Add(entry)
+    box.Add(chk)
+    dlg.ShowAll()
+
+    if dlg.Run() != gtk.RESPONSE_ACCEPT {
+        return "", false, false
+    }
+    password, _ = entry.GetText()
+    return password, chk.GetActive(), true
+}
+
+// Ask how zip entry names should be decoded, ok is false if the
+// user cancelled
+func (u *UI) PromptNameEncoding(current util.NameEncoding) (enc util.NameEncoding, ok bool) {
+    dlg, err := gtk.DialogNewWithButtons("Name Encoding", u.MainWindow,
+        gtk.DialogFlags(gtk.DIALOG_MODAL),
+        []interface{}{"_Cancel", gtk.RESPONSE_CANCEL},
+        []interface{}{"_Reopen", gtk.RESPONSE_ACCEPT})
+    if err != nil {
+        return current, false
+    }
+    defer dlg.Destroy()
+    dlg.SetDefaultResponse(gtk.RESPONSE_ACCEPT)
+    css, _ := dlg.GetStyleContext()
+    css.AddClass("msg-dlg")
+
+    lbl, _ := gtk.LabelNew("Decode page names as")
+    combo, _ := gtk.ComboBoxTextNew()
+    for i, e := range util.NameEncodings {
+        combo.AppendText(e.String())
+        if e == current {
+            combo.SetActive(i)
+        }
+    }
+
+    box, _ := dlg.GetContentArea()
+    box.SetSpacing(8)
+    box.Add(lbl)
+    box.Add(combo)
+    dlg.ShowAll()
+
+    if dlg.Run() != gtk.RESPONSE_ACCEPT {
+        return current, false
+    }
+    i := combo.GetActive()
+    if i < 0 || i >= len(util.NameEncodings) {
+        return current, false
+    }
+    return util.NameEncodings[i], true
+}
+
+// How big the page is drawn in the crop dialog, at most
+const CROP_PREVIEW_W = 240
+const CROP_PREVIEW_H = 320
+
+// Let the user set how much is cropped off each side of img, with a
+// preview. Automatic is true if they'd rather have the worked out crop
+// back, ok is false if they cancelled
+func (u *UI) PromptCrop(img *gdk.Pixbuf, crop util.Crop) (c util.Crop, automatic bool, ok bool) {
+    dlg, err := gtk.DialogNewWithButtons("Crop Page", u.MainWindow,
+        gtk.DialogFlags(gtk.DIALOG_MODAL),
+        []interface{}{"_Cancel", gtk.RESPONSE_CANCEL},
+        []interface{}{"A_utomatic", gtk.RESPONSE_REJECT},
+        []interface{}{"_Apply", gtk.RESPONSE_ACCEPT})
+    if err != nil {
+        return crop, false, false
+    }
+    defer dlg.Destroy()
+    dlg.SetDefaultResponse(gtk.RESPONSE_ACCEPT)
+    css, _ := dlg.GetStyleContext()
+    css.AddClass("msg-dlg")
+
+    grid, _ := gtk.GridNew()
+    grid.SetColumnSpacing(8)
+    grid.SetRowSpacing(4)
+    names := []string{"Left %", "Top %", "Right %", "Bottom %"}
+    values := []float64{crop.Left, crop.Top, crop.Right, crop.Bottom}
+    spins := make([]*gtk.SpinButton, len(names))
+    for i := range names {
+        lbl, _ := gtk.LabelNew(names[i])
+        spins[i], _ = gtk.SpinButtonNewWithRange(0, util.CROP_MAX*100, 0.5)
+        spins[i].SetDigits(1)
+        spins[i].SetValue(values[i] * 100)
+        spins[i].SetActivatesDefault(true)
+        grid.Attach(lbl, 0, i, 1, 1)
+        grid.Attach(spins[i], 1, i, 1, 1)
+    }
+    current := func() util.Crop {
+        return util.Crop{
+            Left:   spins[0].GetValue() / 100,
+            Top:    spins[1].GetValue() / 100,
+            Right:  spins[2].GetValue() / 100,
+            Bottom: spins[3].GetValue() / 100,
+        }
+    }
+
+    box, _ := dlg.GetContentArea()
+    box.SetSpacing(8)
+
+    // What's cropped off is shaded over the page
+    if img != nil {
+        preview, err := scalePixbufToFit(img, CROP_PREVIEW_W, CROP_PREVIEW_H)
+        if err == nil {
+            pW, pH := preview.GetWidth(), preview.GetHeight()
+            area, _ := gtk.DrawingAreaNew()
+            area.SetSizeRequest(pW, pH)
+            area.SetHAlign(gtk.ALIGN_CENTER)
+            area.Connect("draw", func(da *gtk.DrawingArea, cr *cairo.Context) bool {
+                gtk.GdkCairoSetSourcePixBuf(cr, preview, 0, 0)
+                cr.Paint()
+                r := current().Rect(pW, pH)
+                cr.SetSourceRGBA(0, 0, 0, 0.6)
+                cr.SetFillRule(cairo.FILL_RULE_EVEN_ODD)
+                cr.Rectangle(0, 0, float64(pW), float64(pH))
+                cr.Rectangle(float64(r.Min.X), float64(r.Min.Y), float64(r.Dx()), float64(r.Dy()))
+                cr.Fill()
+                return true
+            })
+            for i := range spins {
+                spins[i].Connect("value-changed", func() {
+                    area.QueueDraw()
+                })
+            }
+            box.Add(area)
+        }
+    }
+    box.Add(grid)
+    dlg.ShowAll()
+
+    switch dlg.Run() {
+    case gtk.RESPONSE_ACCEPT:
+        return current(), false, true
+    case gtk.RESPONSE_REJECT:
+        return crop, true, true
+    }
+    return crop, false, false
+}
+
 func (u *UI) ShowCursor() {
     d, _ := gdk.DisplayGetDefault()
     c, _ := gdk.CursorNewFromName(d, "default")
@@ -0,0 +1,100 @@
+package util
+
+import (
+    "encoding/xml"
+    "io/fs"
+    "path/filepath"
+    "strings"
+)
+
+// ComicInfo.xml is the de facto standard metadata file that
+// comic management tools store at the root of a cbx archive
+const COMICINFO_FN string = "comicinfo.xml"
+
+// Only the parts of the ComicInfo schema that affect how
+// the comic is displayed are decoded
+type ComicInfo struct {
+    XMLName xml.Name        `xml:"ComicInfo"`
+    Title   string          `xml:"Title"`
+    Series  string          `xml:"Series"`
+    Number  string          `xml:"Number"`
+    Manga   string          `xml:"Manga"`
+    Pages   []ComicPageInfo `xml:"Pages>Page"`
+}
+
+// Image is the index, in natural order, of the image the entry describes
+// Type is a ComicPageType, in newer schemas a space separated list of them
+// Path is the image Image resolved to, see OrderPages
+type ComicPageInfo struct {
+    Image      int    `xml:"Image,attr"`
+    Type       string `xml:"Type,attr"`
+    DoublePage string `xml:"DoublePage,attr"`
+    Path       string `xml:"-"`
+}
+
+func IsComicInfo(name string) bool {
+    return strings.ToLower(filepath.Base(name)) == COMICINFO_FN
+}
+
+func ParseComicInfo(data []byte) (*ComicInfo, error) {
+    var ci ComicInfo
+    err := xml.Unmarshal(data, &ci)
+    if err != nil {
+        return nil, err
+    }
+    return &ci, nil
+}
+
+// Sources with metadata of their own, like epub, provide it as a ComicInfo
+type comicInfoSource interface {
+    ComicInfo() *ComicInfo
+}
+
+// Find and parse the ComicInfo.xml stored with the pages of src
+// Returns an error satisfying os.ErrNotExist if there isn't one
+func ReadComicInfo(src PageSource) (*ComicInfo, error) {
+    if cs, ok := src.(comicInfoSource); ok && cs.ComicInfo() != nil {
+        return cs.ComicInfo(), nil
+    }
+
+    for _, n := range src.Entries() {
+        if IsComicInfo(n) {
+            b, err := src.ReadEntry(n)
+            if err != nil {
+                return nil, err
+            }
+            return ParseComicInfo(b)
+        }
+    }
+    return nil, fs.ErrNotExist
+}
+
+func (ci *ComicInfo) RightToLeft() bool {
+    return ci.Manga == "YesAndRightToLeft"
+}
+
+func (p *ComicPageInfo) types() []string {
+    return strings.FieldsFunc(strings.ToLower(p.Type), func(r rune) bool {
+        return r == ' ' || r == ','
+    })
+}
+
+func (p *ComicPageInfo) hasType(t string) bool {
+    for _, pt := range p.types() {
+        if pt == t {
+            return true
+        }
+    }
+    return false
+}
+
+// Some tools mark a spread with the DoublePage attribute, others with
+// the Type, accept either
+func (p *ComicPageInfo) IsDoublePage() bool {
+    return strings.EqualFold(p.DoublePage, "true") || p.hasType("doublepage")
+}
+
+// Pages that should start out hidden
+func (p *ComicPageInfo) IsHidden() bool {
+    return p.hasType("deleted") || p.hasType("advertisement")
+}
@@ -0,0 +1,190 @@
+package util
+
+import (
+    "fmt"
+    "image"
+    "strconv"
+    "strings"
+)
+
+/*
+ * A Crop is how much to trim off each side of a page, as a fraction of
+ * the page's width or height, so it holds whatever size the page is
+ * drawn at. Pages get one worked out from their pixels, see
+ * ContentBounds, which the user can override by hand.
+ */
+type Crop struct {
+    Left   float64 `json:"left,omitempty"`
+    Top    float64 `json:"top,omitempty"`
+    Right  float64 `json:"right,omitempty"`
+    Bottom float64 `json:"bottom,omitempty"`
+}
+
+// Tuning for ContentBounds. Levels are luminance, 0-255
+const (
+    // How far a pixel can be from the border's color and still be border
+    CROP_TOLERANCE = 32
+    // Specks of dust per 1000 pixels a line can have and still be border
+    CROP_NOISE = 5
+    // No side is trimmed by more than this, a page that's mostly blank
+    // is left alone
+    CROP_MAX = 0.4
+    // Put back round the content so it isn't cut right at the ink
+    CROP_MARGIN = 0.005
+)
+
+func (c Crop) IsZero() bool {
+    return c == Crop{}
+}
+
+// Each side between 0 and CROP_MAX, so there's always some page left
+func (c Crop) Valid() bool {
+    for _, f := range []float64{c.Left, c.Top, c.Right, c.Bottom} {
+        if f < 0 || f > CROP_MAX {
+            return false
+        }
+    }
+    return true
+}
+
+// The same crop on the page turned degrees clockwise
+func (c Crop) Rotate(degrees int) Crop {
+    switch ((degrees % 360) + 360) % 360 {
+    case 90:
+        return Crop{Left: c.Bottom, Top: c.Left, Right: c.Top, Bottom: c.Right}
+    case 180:
+        return Crop{Left: c.Right, Top: c.Bottom, Right: c.Left, Bottom: c.Top}
+    case 270:
+        return Crop{Left: c.Top, Top: c.Right, Right: c.Bottom, Bottom: c.Left}
+    }
+    return c
+}
+
+// What's left of a w by h page, never less than a pixel
+func (c Crop) Rect(w int, h int) image.Rectangle {
+    x0 := int(c.Left * float64(w))
+    y0 := int(c.Top * float64(h))
+    x1 := w - int(c.Right*float64(w))
+    y1 := h - int(c.Bottom*float64(h))
+    if x1 <= x0 {
+        x0, x1 = 0, w
+    }
+    if y1 <= y0 {
+        y0, y1 = 0, h
+    }
+    return image.Rect(x0, y0, x1, y1)
+}
+
+// Percentages, left,top,right,bottom, as they're passed in messages
+func (c Crop) String() string {
+    return fmt.Sprintf("%g,%g,%g,%g", c.Left*100, c.Top*100, c.Right*100, c.Bottom*100)
+}
+
+func ParseCrop(s string) (Crop, error) {
+    f := strings.Split(s, ",")
+    if len(f) != 4 {
+        return Crop{}, fmt.Errorf("bad crop %q", s)
+    }
+    var v [4]float64
+    for i := range f {
+        n, err := strconv.ParseFloat(strings.TrimSpace(f[i]), 64)
+        if err != nil {
+            return Crop{}, fmt.Errorf("bad crop %q", s)
+        }
+        v[i] = n / 100
+    }
+    c := Crop{v[0], v[1], v[2], v[3]}
+    if !c.Valid() {
+        return Crop{}, fmt.Errorf("bad crop %q", s)
+    }
+    return c, nil
+}
+
+/*
+ * Works out the crop for a page's pixels, 8 bit rgb(a) like a pixbuf.
+ * Each side is trimmed while its outermost line is all one shade, white
+ * paper, black scanner lid or whatever else, give or take some dust. A
+ * side whose edge isn't a solid border isn't trimmed at all, so pages
+ * printed to the edge stay as they are. Sides are gone round until none
+ * of them can be trimmed any more, since a border down one side cuts
+ * across the border along the top.
+ */
+func ContentBounds(pix []byte, stride int, channels int, w int, h int) Crop {
+    if w < 8 || h < 8 || channels < 3 || len(pix) < (h-1)*stride+w*channels {
+        return Crop{}
+    }
+    lum := func(x int, y int) int {
+        i := y*stride + x*channels
+        return (int(pix[i])*299 + int(pix[i+1])*587 + int(pix[i+2])*114) / 1000
+    }
+
+    // Whether the line of n pixels starting at x,y going dx,dy is
+    // all one shade, the shade of its middle, which is the likeliest
+    // part to be border if any of it is
+    border := func(x int, y int, dx int, dy int, n int) bool {
+        ref := lum(x+dx*(n/2), y+dy*(n/2))
+        bad := 0
+        max := n * CROP_NOISE / 1000
+        for i := 0; i < n; i++ {
+            d := lum(x, y) - ref
+            if d < -CROP_TOLERANCE || d > CROP_TOLERANCE {
+                bad++
+                if bad > max {
+                    return false
+                }
+            }
+            x += dx
+            y += dy
+        }
+        return true
+    }
+
+    // What's left is x0,y0 to x1,y1, exclusive
+    x0, y0, x1, y1 := 0, 0, w, h
+    maxX := int(float64(w) * CROP_MAX)
+    maxY := int(float64(h) * CROP_MAX)
+    for trimmed := true; trimmed; {
+        trimmed = false
+        for y0 < maxY && border(x0, y0, 1, 0, x1-x0) {
+            y0++
+            trimmed = true
+        }
+        for h-y1 < maxY && border(x0, y1-1, 1, 0, x1-x0) {
+            y1--
+            trimmed = true
+        }
+        for x0 < maxX && border(x0, y0, 0, 1, y1-y0) {
+            x0++
+            trimmed = true
+        }
+        for w-x1 < maxX && border(x1-1, y0, 0, 1, y1-y0) {
+            x1--
+            trimmed = true
+        }
+    }
+
+    // Hit the limit, there's no telling where the content is
+    if y0 >= maxY || h-y1 >= maxY {
+        y0, y1 = 0, h
+    }
+    if x0 >= maxX || w-x1 >= maxX {
+        x0, x1 = 0, w
+    }
+
+    trim := func(px int, size int) float64 {
+        if px == 0 {
+            return 0
+        }
+        f := float64(px)/float64(size) - CROP_MARGIN
+        if f < 0 {
+            return 0
+        }
+        return f
+    }
+    return Crop{
+        Left:   trim(x0, w),
+        Top:    trim(y0, h),
+        Right:  trim(w-x1, w),
+        Bottom: trim(h-y1, h),
+    }
+}
@@ -0,0 +1,255 @@
+package util
+
+import (
+    "bufio"
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "image"
+    "image/draw"
+    _ "image/gif"
+    _ "image/jpeg"
+    _ "image/png"
+    "io"
+
+    "github.com/gen2brain/avif"
+    "github.com/gen2brain/heic"
+    "github.com/gen2brain/jpegxl"
+    _ "golang.org/x/image/bmp"
+    _ "golang.org/x/image/tiff"
+    _ "golang.org/x/image/webp"
+)
+
+/*
+ * Pages are decoded by a chain, gdk-pixbuf first, since it's quickest
+ * and reads anything there's a loader installed for, then go, for
+ * whatever gdk couldn't, see ImgNewFromBytes. Either way what an image
+ * is comes from its first few bytes, not the name of the entry it's in.
+ */
+type ImageType string
+
+const (
+    IMAGE_UNKNOWN ImageType = ""
+    IMAGE_JPEG    ImageType = "jpeg"
+    IMAGE_PNG     ImageType = "png"
+    IMAGE_GIF     ImageType = "gif"
+    IMAGE_WEBP    ImageType = "webp"
+    IMAGE_BMP     ImageType = "bmp"
+    IMAGE_TIFF    ImageType = "tiff"
+    IMAGE_AVIF    ImageType = "avif"
+    IMAGE_HEIC    ImageType = "heic"
+    IMAGE_JXL     ImageType = "jxl"
+)
+
+// Go has nothing that reads the image, gdk may still
+var ErrNoDecoder = errors.New("no decoder")
+
+// Enough of the start of an image to tell what it is
+const IMAGE_SNIFF_LEN = 64
+
+var (
+    jpegMagic    = []byte("\xff\xd8\xff")
+    pngMagic     = []byte("\x89PNG\r\n\x1a\n")
+    gif87Magic   = []byte("GIF87a")
+    gif89Magic   = []byte("GIF89a")
+    bmpMagic     = []byte("BM")
+    tiffLEMagic  = []byte("II*\x00")
+    tiffBEMagic  = []byte("MM\x00*")
+    jxlMagic     = []byte("\xff\x0a")
+    jxlBoxMagic  = []byte("\x00\x00\x00\x0cJXL \x0d\x0a\x87\x0a")
+    heicBrands   = []string{"heic", "heix", "hevc", "hevx", "heim", "heis"}
+    avifBrands   = []string{"avif", "avis"}
+    // Could be avif or heic, the rest of the ftyp box says which
+    heifBrands   = []string{"mif1", "msf1"}
+)
+
+func init() {
+    // Heic, avif and jpeg xl are decoded by libheif, libavif and libjxl,
+    // as shared libraries if there are any, compiled to wasm if not
+    for _, b := range heicBrands {
+        image.RegisterFormat("heic", "????ftyp"+b, heic.Decode, heic.DecodeConfig)
+    }
+    for _, b := range avifBrands {
+        image.RegisterFormat("avif", "????ftyp"+b, avif.Decode, avif.DecodeConfig)
+    }
+    for _, b := range heifBrands {
+        image.RegisterFormat("heif", "????ftyp"+b, decodeHeif, decodeHeifConfig)
+    }
+    image.RegisterFormat("jxl", string(jxlMagic), jpegxl.Decode, jpegxl.DecodeConfig)
+    image.RegisterFormat("jxl", string(jxlBoxMagic), jpegxl.Decode, jpegxl.DecodeConfig)
+}
+
+// A mif1 or msf1 heif goes to whichever of avif or heic its brands say
+func decodeHeif(r io.Reader) (image.Image, error) {
+    r, t := peekHeif(r)
+    if t == IMAGE_AVIF {
+        return avif.Decode(r)
+    }
+    return heic.Decode(r)
+}
+
+func decodeHeifConfig(r io.Reader) (image.Config, error) {
+    r, t := peekHeif(r)
+    if t == IMAGE_AVIF {
+        return avif.DecodeConfig(r)
+    }
+    return heic.DecodeConfig(r)
+}
+
+// What's in the heif r, and r to read it all from
+func peekHeif(r io.Reader) (io.Reader, ImageType) {
+    br := bufio.NewReader(r)
+    b, _ := br.Peek(IMAGE_SNIFF_LEN)
+    return br, SniffImage(b)
+}
+
+func SniffImage(b []byte) ImageType {
+    switch {
+    case bytes.HasPrefix(b, jpegMagic):
+        return IMAGE_JPEG
+    case bytes.HasPrefix(b, pngMagic):
+        return IMAGE_PNG
+    case bytes.HasPrefix(b, gif87Magic), bytes.HasPrefix(b, gif89Magic):
+        return IMAGE_GIF
+    case len(b) >= 12 && string(b[0:4]) == "RIFF" && string(b[8:12]) == "WEBP":
+        return IMAGE_WEBP
+    case bytes.HasPrefix(b, tiffLEMagic), bytes.HasPrefix(b, tiffBEMagic):
+        return IMAGE_TIFF
+    case bytes.HasPrefix(b, jxlMagic), bytes.HasPrefix(b, jxlBoxMagic):
+        return IMAGE_JXL
+    case len(b) >= 12 && string(b[4:8]) == "ftyp":
+        return sniffHeif(b)
+    case bytes.HasPrefix(b, bmpMagic) && len(b) >= 14:
+        return IMAGE_BMP
+    }
+    return IMAGE_UNKNOWN
+}
+
+// Avif and heic are both heif containers, the ftyp box lists brands
+// that say what's inside. Mif1 alone could be either, so avif wins
+// if it's listed anywhere
+func sniffHeif(b []byte) ImageType {
+    size := int(binary.BigEndian.Uint32(b[0:4]))
+    if size > len(b) {
+        size = len(b)
+    }
+    brands := []string{string(b[8:12])}
+    for i := 16; i+4 <= size; i += 4 {
+        brands = append(brands, string(b[i:i+4]))
+    }
+    for _, br := range brands {
+        for _, a := range avifBrands {
+            if br == a {
+                return IMAGE_AVIF
+            }
+        }
+    }
+    for _, br := range brands {
+        for _, h := range append(heicBrands, heifBrands...) {
+            if br == h {
+                return IMAGE_HEIC
+            }
+        }
+    }
+    return IMAGE_UNKNOWN
+}
+
+// What type of image a PageSource entry is
+func SniffEntry(src PageSource, name string) (ImageType, error) {
+    r, err := src.OpenEntry(name)
+    if err != nil {
+        return IMAGE_UNKNOWN, err
+    }
+    defer r.Close()
+    b := make([]byte, IMAGE_SNIFF_LEN)
+    n, err := io.ReadFull(r, b)
+    if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+        return IMAGE_UNKNOWN, err
+    }
+    return SniffImage(b[:n]), nil
+}
+
+/*
+ * Jpegs in cmyk or ycck, (print scans mostly), have four components.
+ * Gdk draws them with the wrong colors, so they're left to go, which
+ * converts them properly, including adobe's inverted cmyk.
+ */
+func IsCMYKJpeg(b []byte) bool {
+    if !bytes.HasPrefix(b, jpegMagic) {
+        return false
+    }
+    i := 2
+    for i+4 <= len(b) {
+        if b[i] != 0xff {
+            return false
+        }
+        marker := b[i+1]
+        if marker == 0xff {
+            i++
+            continue
+        }
+        size := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+
+        // Any start of frame, but not dht, jpg or dac
+        if marker >= 0xc0 && marker <= 0xcf &&
+            marker != 0xc4 && marker != 0xc8 && marker != 0xcc {
+            // Length, precision, height and width, then components
+            if i+9 >= len(b) {
+                return false
+            }
+            return b[i+9] == 4
+        }
+        if marker == 0xda || marker == 0xd9 {
+            return false
+        }
+        i += 2 + size
+    }
+    return false
+}
+
+// The go end of the decoder chain
+func DecodeImage(b []byte) (image.Image, error) {
+    img, _, err := image.Decode(bytes.NewReader(b))
+    if err != nil {
+        if errors.Is(err, image.ErrFormat) {
+            t := SniffImage(b)
+            if t == IMAGE_UNKNOWN {
+                return nil, fmt.Errorf("not a recognized image: %w", ErrNoDecoder)
+            }
+            return nil, fmt.Errorf("%w for %s images", ErrNoDecoder, t)
+        }
+        return nil, err
+    }
+    return img, nil
+}
+
+/*
+ * A page decoded by go alone, so it can be done off the ui thread, the
+ * way up its exif says and then turned rotation degrees clockwise, with
+ * the crop for its content. Pixels only have to be copied into a pixbuf
+ * after, see ImgNewFromImage. Formats only gdk reads are an error, those
+ * have to be loaded the old way, see Page.Load.
+ */
+func DecodePage(b []byte, rotation int) (*image.NRGBA, Crop, error) {
+    img, err := DecodeImage(b)
+    if err != nil {
+        return nil, Crop{}, err
+    }
+    n := OrientNRGBA(toNRGBA(img), JpegOrientation(b))
+    n = OrientNRGBA(n, RotationOrientation(rotation))
+    c := ContentBounds(n.Pix[n.PixOffset(n.Rect.Min.X, n.Rect.Min.Y):], n.Stride, 4,
+        n.Rect.Dx(), n.Rect.Dy())
+    return n, c, nil
+}
+
+// Gdk wants straight alpha, go's own rgba is premultiplied
+func toNRGBA(img image.Image) *image.NRGBA {
+    if n, ok := img.(*image.NRGBA); ok {
+        return n
+    }
+    b := img.Bounds()
+    n := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+    draw.Draw(n, n.Bounds(), img, b.Min, draw.Src)
+    return n
+}
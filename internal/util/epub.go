@@ -0,0 +1,241 @@
+package util
+
+import (
+    "encoding/xml"
+    "errors"
+    "fmt"
+    "net/url"
+    "path"
+    "sort"
+    "strings"
+)
+
+// Where an epub says its package document is
+const EPUB_CONTAINER_FN = "META-INF/container.xml"
+
+type epubContainer struct {
+    Rootfiles []struct {
+        FullPath  string `xml:"full-path,attr"`
+        MediaType string `xml:"media-type,attr"`
+    } `xml:"rootfiles>rootfile"`
+}
+
+// Only the parts of the opf that say what the pages are and how
+// they're laid out are decoded
+type epubPackage struct {
+    Metas []struct {
+        Property string `xml:"property,attr"`
+        Value    string `xml:",chardata"`
+    } `xml:"metadata>meta"`
+    Items []struct {
+        Id        string `xml:"id,attr"`
+        Href      string `xml:"href,attr"`
+        MediaType string `xml:"media-type,attr"`
+    } `xml:"manifest>item"`
+    Spine struct {
+        Direction string `xml:"page-progression-direction,attr"`
+        ItemRefs  []struct {
+            IdRef      string `xml:"idref,attr"`
+            Properties string `xml:"properties,attr"`
+        } `xml:"itemref"`
+    } `xml:"spine"`
+}
+
+/*
+ * A fixed layout epub is a zip of xhtml pages that each show one
+ * image. The spine is the reading order, so the entries are the images
+ * the spine pages show, in that order, and nothing else.
+ *
+ * The layout hints are passed on as a ComicInfo, so they're applied
+ * the same way, and overridden by the user's layout the same way, as
+ * those of a cbz. Right to left page progression makes it manga and
+ * any page the epub wants shown on its own is a DoublePage.
+ */
+type epubSource struct {
+    *zipSource
+    pages []string
+    ci    *ComicInfo
+}
+
+func openEpubSource(filePath string, limits Limits) (*epubSource, error) {
+    zs, err := openZipSource(filePath, OpenOptions{Limits: limits})
+    if err != nil {
+        return nil, err
+    }
+
+    s := &epubSource{zipSource: zs}
+    err = s.readPackage()
+    if err != nil {
+        zs.Close()
+        return nil, err
+    }
+    if len(s.pages) == 0 {
+        zs.Close()
+        return nil, errors.New("epub has no page images")
+    }
+    return s, nil
+}
+
+func (s *epubSource) readPackage() error {
+    b, err := s.ReadEntry(EPUB_CONTAINER_FN)
+    if err != nil {
+        return err
+    }
+    var c epubContainer
+    err = xml.Unmarshal(b, &c)
+    if err != nil {
+        return fmt.Errorf("%s: %w", EPUB_CONTAINER_FN, err)
+    }
+    if len(c.Rootfiles) == 0 {
+        return fmt.Errorf("%s: no rootfile", EPUB_CONTAINER_FN)
+    }
+
+    opfPath := c.Rootfiles[0].FullPath
+    b, err = s.ReadEntry(opfPath)
+    if err != nil {
+        return err
+    }
+    var pkg epubPackage
+    err = xml.Unmarshal(b, &pkg)
+    if err != nil {
+        return fmt.Errorf("%s: %w", opfPath, err)
+    }
+
+    // The book wide spread setting, itemrefs can override it
+    spreadNone := false
+    for _, m := range pkg.Metas {
+        if m.Property == "rendition:spread" {
+            spreadNone = strings.TrimSpace(m.Value) == "none"
+        }
+    }
+
+    type item struct {
+        href      string
+        mediaType string
+    }
+    items := make(map[string]item)
+    for _, it := range pkg.Items {
+        items[it.Id] = item{epubResolve(opfPath, it.Href), it.MediaType}
+    }
+
+    var alone []bool
+    seen := make(map[string]bool)
+    for _, ir := range pkg.Spine.ItemRefs {
+        it, ok := items[ir.IdRef]
+        if !ok {
+            continue
+        }
+
+        img := it.href
+        if !strings.HasPrefix(it.mediaType, "image/") {
+            img, err = s.pageImage(it.href)
+            if err != nil {
+                fmt.Printf("Warning skipping epub page %s; %s\n", it.href, err)
+                continue
+            }
+        }
+        if _, ok := s.files[img]; !ok || !validImageExt(strings.ToLower(path.Ext(img))) {
+            continue
+        }
+        if seen[img] {
+            continue
+        }
+        seen[img] = true
+
+        props := strings.Fields(ir.Properties)
+        single := spreadNone
+        for _, p := range props {
+            switch p {
+            case "rendition:spread-none", "rendition:page-spread-center":
+                single = true
+            case "rendition:spread-auto", "rendition:spread-both",
+                "rendition:spread-landscape", "rendition:spread-portrait":
+                single = false
+            }
+        }
+        s.pages = append(s.pages, img)
+        alone = append(alone, single)
+    }
+
+    s.ci = epubComicInfo(s.pages, alone, pkg.Spine.Direction == "rtl")
+    return nil
+}
+
+// The first image an xhtml page shows, as an img or an svg image
+func (s *epubSource) pageImage(docPath string) (string, error) {
+    r, err := s.OpenEntry(docPath)
+    if err != nil {
+        return "", err
+    }
+    defer r.Close()
+
+    d := xml.NewDecoder(r)
+    d.Strict = false
+    d.AutoClose = xml.HTMLAutoClose
+    d.Entity = xml.HTMLEntity
+    for {
+        t, err := d.Token()
+        if err != nil {
+            return "", fmt.Errorf("no image found; %w", err)
+        }
+        se, ok := t.(xml.StartElement)
+        if !ok {
+            continue
+        }
+        for _, a := range se.Attr {
+            if (se.Name.Local == "img" && a.Name.Local == "src") ||
+                (se.Name.Local == "image" && a.Name.Local == "href") {
+                return epubResolve(docPath, a.Value), nil
+            }
+        }
+    }
+}
+
+// Hrefs are relative to the document they're in and url escaped
+func epubResolve(docPath string, href string) string {
+    if i := strings.IndexByte(href, '#'); i >= 0 {
+        href = href[:i]
+    }
+    if u, err := url.PathUnescape(href); err == nil {
+        href = u
+    }
+    return path.Join(path.Dir(docPath), href)
+}
+
+// ComicInfo page Image indexes are into the natural order of the
+// pages, see OrderPages, so that's recreated here
+func epubComicInfo(pages []string, alone []bool, rtl bool) *ComicInfo {
+    natural := make([]string, len(pages))
+    copy(natural, pages)
+    sort.SliceStable(natural, func(i, j int) bool {
+        return pageLess(natural[i], natural[j])
+    })
+    idxs := make(map[string]int)
+    for i := range natural {
+        if _, ok := idxs[natural[i]]; !ok {
+            idxs[natural[i]] = i
+        }
+    }
+
+    ci := &ComicInfo{}
+    if rtl {
+        ci.Manga = "YesAndRightToLeft"
+    }
+    for i, p := range pages {
+        cp := ComicPageInfo{Image: idxs[p]}
+        if alone[i] {
+            cp.DoublePage = "true"
+        }
+        ci.Pages = append(ci.Pages, cp)
+    }
+    return ci
+}
+
+// Only the spine's images are pages
+func (s *epubSource) Entries() []string {
+    return s.pages
+}
+
+func (s *epubSource) ComicInfo() *ComicInfo {
+    return s.ci
+}
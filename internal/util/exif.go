@@ -0,0 +1,184 @@
+package util
+
+import (
+    "bytes"
+    "encoding/binary"
+    "image"
+    "io"
+)
+
+/*
+ * Jpegs from phones, and some re-encoded scans, are stored sideways
+ * with an exif Orientation tag saying which way up they go. Neither
+ * gdk nor go turn them for us, so pages are turned as they're loaded,
+ * see ImgNewFromBytes, and their sizes are reported turned too, so
+ * everything that goes by a page's width and height sees the same page.
+ *
+ * The values are exif's, 1 is as stored, 2-4 are mirrored and/or
+ * upside down and 5-8 are on their side.
+ */
+const (
+    ORIENTATION_NORMAL     = 1
+    ORIENTATION_FLIP_H     = 2
+    ORIENTATION_ROTATE_180 = 3
+    ORIENTATION_FLIP_V     = 4
+    ORIENTATION_TRANSPOSE  = 5
+    ORIENTATION_ROTATE_CW  = 6
+    ORIENTATION_TRANSVERSE = 7
+    ORIENTATION_ROTATE_CCW = 8
+)
+
+const EXIF_TAG_ORIENTATION = 0x0112
+
+// The orientation from a jpeg's exif, b only has to be long enough to
+// hold the exif segment. Normal for anything else
+func JpegOrientation(b []byte) int {
+    if !bytes.HasPrefix(b, jpegMagic) {
+        return ORIENTATION_NORMAL
+    }
+    i := 2
+    for i+4 <= len(b) {
+        if b[i] != 0xff {
+            break
+        }
+        marker := b[i+1]
+        if marker == 0xff {
+            i++
+            continue
+        }
+        // Restart markers and tem have no length
+        if marker == 0x01 || (marker >= 0xd0 && marker <= 0xd7) {
+            i += 2
+            continue
+        }
+        if marker == 0xda || marker == 0xd9 {
+            break
+        }
+        size := int(binary.BigEndian.Uint16(b[i+2 : i+4]))
+        if size < 2 {
+            break
+        }
+        seg := b[i+4 : min(i+2+size, len(b))]
+        if marker == 0xe1 && bytes.HasPrefix(seg, []byte("Exif\x00\x00")) {
+            return tiffOrientation(seg[6:])
+        }
+        i += 2 + size
+    }
+    return ORIENTATION_NORMAL
+}
+
+// Exif is a little tiff, orientation lives in its first ifd
+func tiffOrientation(t []byte) int {
+    if len(t) < 8 {
+        return ORIENTATION_NORMAL
+    }
+    var bo binary.ByteOrder
+    switch string(t[0:2]) {
+    case "II":
+        bo = binary.LittleEndian
+    case "MM":
+        bo = binary.BigEndian
+    default:
+        return ORIENTATION_NORMAL
+    }
+    if bo.Uint16(t[2:4]) != 42 {
+        return ORIENTATION_NORMAL
+    }
+    ifd := int(bo.Uint32(t[4:8]))
+    if ifd < 8 || ifd+2 > len(t) {
+        return ORIENTATION_NORMAL
+    }
+    n := int(bo.Uint16(t[ifd : ifd+2]))
+    for j := 0; j < n; j++ {
+        e := ifd + 2 + j*12
+        if e+12 > len(t) {
+            break
+        }
+        if bo.Uint16(t[e:e+2]) != EXIF_TAG_ORIENTATION {
+            continue
+        }
+        // A short, stored in the first bytes of the value
+        o := int(bo.Uint16(t[e+8 : e+10]))
+        if o < ORIENTATION_NORMAL || o > ORIENTATION_ROTATE_CCW {
+            return ORIENTATION_NORMAL
+        }
+        return o
+    }
+    return ORIENTATION_NORMAL
+}
+
+// Width and height of an image once it's turned the right way up
+func OrientedSize(w int, h int, orientation int) (int, int) {
+    if orientation >= ORIENTATION_TRANSPOSE {
+        return h, w
+    }
+    return w, h
+}
+
+// Like image.DecodeConfig, but the size is the turned one. Jpeg headers
+// are read up to the frame, which comes after the exif, so whatever
+// DecodeConfig reads is enough to find the orientation in
+func decodeOrientedConfig(r io.Reader) (image.Config, string, error) {
+    var hdr bytes.Buffer
+    cfg, format, err := image.DecodeConfig(io.TeeReader(r, &hdr))
+    if err != nil {
+        return cfg, format, err
+    }
+    if format == "jpeg" {
+        cfg.Width, cfg.Height = OrientedSize(cfg.Width, cfg.Height, JpegOrientation(hdr.Bytes()))
+    }
+    return cfg, format, nil
+}
+
+// img turned from the way it was stored to the way up orientation says,
+// the same as imgOrient does for pixbufs
+func OrientNRGBA(img *image.NRGBA, orientation int) *image.NRGBA {
+    if orientation <= ORIENTATION_NORMAL || orientation > ORIENTATION_ROTATE_CCW {
+        return img
+    }
+    b := img.Bounds()
+    w, h := b.Dx(), b.Dy()
+    dw, dh := OrientedSize(w, h, orientation)
+    d := image.NewNRGBA(image.Rect(0, 0, dw, dh))
+
+    // Where in img each pixel of d comes from
+    src := func(x int, y int) (int, int) {
+        switch orientation {
+        case ORIENTATION_FLIP_H:
+            return w - 1 - x, y
+        case ORIENTATION_ROTATE_180:
+            return w - 1 - x, h - 1 - y
+        case ORIENTATION_FLIP_V:
+            return x, h - 1 - y
+        case ORIENTATION_TRANSPOSE:
+            return y, x
+        case ORIENTATION_ROTATE_CW:
+            return y, h - 1 - x
+        case ORIENTATION_TRANSVERSE:
+            return w - 1 - y, h - 1 - x
+        }
+        return w - 1 - y, x
+    }
+    for y := 0; y < dh; y++ {
+        row := d.Pix[y*d.Stride:]
+        for x := 0; x < dw; x++ {
+            sx, sy := src(x, y)
+            i := img.PixOffset(b.Min.X+sx, b.Min.Y+sy)
+            copy(row[x*4:x*4+4], img.Pix[i:i+4])
+        }
+    }
+    return d
+}
+
+// The orientation that turns an image degrees clockwise, in steps of 90
+func RotationOrientation(degrees int) int {
+    switch ((degrees % 360) + 360) % 360 {
+    case 90:
+        return ORIENTATION_ROTATE_CW
+    case 180:
+        return ORIENTATION_ROTATE_180
+    case 270:
+        return ORIENTATION_ROTATE_CCW
+    }
+    return ORIENTATION_NORMAL
+}
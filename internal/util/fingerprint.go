@@ -0,0 +1,333 @@
+package util
+
+import (
+    "crypto/sha256"
+    "encoding/binary"
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "regexp"
+    "sort"
+    "strings"
+    "time"
+)
+
+const FINGERPRINTS_FN string = "fingerprints.json"
+
+// The legacy state still to be migrated, see readLegacyIndex
+const LEGACY_INDEX_FN string = "legacystate.json"
+
+// Versions the way fingerprints are made, and keeps them from
+// being mistaken for the md5s layouts used to be keyed by
+const FINGERPRINT_PREFIX string = "fp1-"
+
+// A fingerprint hashes the size and this many blocks spread
+// evenly through the file, files smaller than that are hashed whole
+const FINGERPRINT_SAMPLES = 16
+const FINGERPRINT_BLOCK_SIZE = 64 << 10
+
+// Most files remembered in the fingerprint cache
+const FINGERPRINT_CACHE_MAX = 2000
+
+// How stale when a file was last used gets before it's updated, it's
+// only for forgetting the least recently used, so it needn't be exact
+const FINGERPRINT_USED_SECS = 24 * 60 * 60
+
+// Layouts and bookmarks used to be keyed by an md5 of the whole file
+var legacyStateName = regexp.MustCompile(`^[0-9a-f]{32}\.json$`)
+
+type fingerprintEntry struct {
+    Size        int64  `json:"size"`
+    ModTime     int64  `json:"modTime"`
+    Fingerprint string `json:"fingerprint"`
+    Used        int64  `json:"used"`
+}
+
+/*
+ * Identifies the contents of a cbx file well enough to key its layout
+ * and bookmarks, without reading the whole thing. It's a hash of the
+ * size and a sample of blocks from the start, end and in between, so
+ * it's about as quick for a 500MB omnibus on a network drive as it is
+ * for a 20MB issue.
+ *
+ * Fingerprints are cached by path, size and modification time, so
+ * opening the same file again doesn't read it at all.
+ *
+ * The first time a file is fingerprinted any state saved under its md5
+ * for its path is moved to the fingerprint, see migrateLegacyState.
+ */
+func Fingerprint(filePath string) (string, error) {
+    absPath, err := filepath.Abs(filePath)
+    if err != nil {
+        return "", err
+    }
+    info, err := os.Stat(absPath)
+    if err != nil {
+        return "", err
+    }
+
+    cache := readFingerprintCache()
+    e, ok := cache[absPath]
+    if ok && e.Size == info.Size() && e.ModTime == info.ModTime().UnixNano() {
+        now := time.Now().Unix()
+        if now-e.Used > FINGERPRINT_USED_SECS {
+            e.Used = now
+            cache[absPath] = e
+            writeFingerprintCache(cache)
+        }
+        return e.Fingerprint, nil
+    }
+
+    fp, err := sampleFingerprint(absPath, info.Size())
+    if err != nil {
+        return "", err
+    }
+
+    // Not being able to migrate costs the old state, not the file
+    err = migrateLegacyState(absPath, fp)
+    if err != nil {
+        fmt.Printf("Warning unable to migrate saved state %s\n", err)
+    }
+
+    cache[absPath] = fingerprintEntry{
+        Size:        info.Size(),
+        ModTime:     info.ModTime().UnixNano(),
+        Fingerprint: fp,
+        Used:        time.Now().Unix(),
+    }
+    writeFingerprintCache(cache)
+    return fp, nil
+}
+
+func sampleFingerprint(filePath string, size int64) (string, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return "", err
+    }
+    defer f.Close()
+
+    h := sha256.New()
+    binary.Write(h, binary.LittleEndian, size)
+    if size <= FINGERPRINT_SAMPLES*FINGERPRINT_BLOCK_SIZE {
+        if _, err := io.Copy(h, f); err != nil {
+            return "", err
+        }
+    } else {
+        buf := make([]byte, FINGERPRINT_BLOCK_SIZE)
+        last := size - FINGERPRINT_BLOCK_SIZE
+        for i := int64(0); i < FINGERPRINT_SAMPLES; i++ {
+            off := last * i / (FINGERPRINT_SAMPLES - 1)
+            if _, err := f.ReadAt(buf, off); err != nil {
+                return "", err
+            }
+            h.Write(buf)
+        }
+    }
+    return fmt.Sprintf("%s%x", FINGERPRINT_PREFIX, h.Sum(nil)[:16]), nil
+}
+
+func fingerprintCachePath() (string, error) {
+    p, err := cachePath()
+    if err != nil {
+        return p, err
+    }
+    return filepath.Join(p, FINGERPRINTS_FN), nil
+}
+
+// A missing or broken cache is just an empty one
+func readFingerprintCache() map[string]fingerprintEntry {
+    cache := make(map[string]fingerprintEntry)
+    fn, err := fingerprintCachePath()
+    if err != nil {
+        return cache
+    }
+    b, err := os.ReadFile(fn)
+    if err != nil {
+        return cache
+    }
+    if err := json.Unmarshal(b, &cache); err != nil {
+        return make(map[string]fingerprintEntry)
+    }
+    return cache
+}
+
+// Least recently used files are forgotten first
+func writeFingerprintCache(cache map[string]fingerprintEntry) {
+    if len(cache) > FINGERPRINT_CACHE_MAX {
+        paths := make([]string, 0, len(cache))
+        for p := range cache {
+            paths = append(paths, p)
+        }
+        sort.Slice(paths, func(i, j int) bool {
+            return cache[paths[i]].Used < cache[paths[j]].Used
+        })
+        for _, p := range paths[:len(cache)-FINGERPRINT_CACHE_MAX] {
+            delete(cache, p)
+        }
+    }
+
+    data, err := json.Marshal(cache)
+    if err != nil {
+        return
+    }
+    p, err := cachePath()
+    if err != nil {
+        return
+    }
+    writeStateFile(p, FINGERPRINTS_FN, string(data))
+}
+
+// Just enough of a layout or bookmark list to say what it's for
+type legacyState struct {
+    Comic struct {
+        FilePath string `json:"filePath"`
+    } `json:"comic"`
+}
+
+/*
+ * Layouts and bookmarks saved under the md5 of filePath are renamed to
+ * its fingerprint. Hashing the whole file is what fingerprints avoid,
+ * so it's only done when there's legacy state that could be for this
+ * file, ie. state saved for this path, or for a path with the same
+ * name that's either relative, (cbxv used to keep paths the way it was
+ * given them, so they depend on where it was run from), or gone, which
+ * could be this file before it was moved.
+ */
+func migrateLegacyState(filePath string, fp string) error {
+    var dirs []string
+    for _, pf := range []func() (string, error){layoutsPath, bookmarksPath} {
+        d, err := pf()
+        if err != nil {
+            return err
+        }
+        dirs = append(dirs, d)
+    }
+
+    index := readLegacyIndex(dirs)
+    base := filepath.Base(filePath)
+    candidates := false
+    for _, e := range index[base] {
+        if e.Path == filePath || !filepath.IsAbs(e.Path) {
+            candidates = true
+            break
+        }
+        if _, err := os.Stat(e.Path); errors.Is(err, fs.ErrNotExist) {
+            candidates = true
+            break
+        }
+    }
+    if !candidates {
+        return nil
+    }
+
+    hash, err := HashFile(filePath)
+    if err != nil {
+        return err
+    }
+    for _, d := range dirs {
+        src := filepath.Join(d, fmt.Sprintf("%s.json", hash))
+        dst := filepath.Join(d, fmt.Sprintf("%s.json", fp))
+        if _, err := os.Stat(src); err != nil {
+            continue
+        }
+        if _, err := os.Stat(dst); err == nil {
+            continue
+        }
+        if err := os.Rename(src, dst); err != nil {
+            return err
+        }
+    }
+
+    // What was saved for this path and didn't match is for the file
+    // before it changed, there's nothing to find next time either.
+    // The rest may be for other files with the same name
+    var rest []legacyIndexEntry
+    for _, e := range index[base] {
+        if e.Md5 != hash && e.Path != filePath {
+            rest = append(rest, e)
+        }
+    }
+    if len(rest) > 0 {
+        index[base] = rest
+    } else {
+        delete(index, base)
+    }
+    writeLegacyIndex(index)
+    return nil
+}
+
+func legacyIndexPath() (string, error) {
+    p, err := cachePath()
+    if err != nil {
+        return p, err
+    }
+    return filepath.Join(p, LEGACY_INDEX_FN), nil
+}
+
+// Legacy state, by the path it was saved for, absolute if it was then
+type legacyIndexEntry struct {
+    Path string `json:"path"`
+    Md5  string `json:"md5"`
+}
+
+/*
+ * The paths legacy state was saved for, with the md5 it was saved
+ * under, by the file name in the path. Every layout and bookmark list
+ * in dirs is read the first time to make it, after that it's kept in
+ * the cache dir and only gets smaller, nothing is saved under an md5
+ * any more.
+ */
+func readLegacyIndex(dirs []string) map[string][]legacyIndexEntry {
+    fn, err := legacyIndexPath()
+    if err == nil {
+        b, err := os.ReadFile(fn)
+        if err == nil {
+            index := make(map[string][]legacyIndexEntry)
+            if json.Unmarshal(b, &index) == nil {
+                return index
+            }
+        }
+    }
+
+    index := make(map[string][]legacyIndexEntry)
+    for _, d := range dirs {
+        entries, err := os.ReadDir(d)
+        if err != nil {
+            continue
+        }
+        for _, e := range entries {
+            if !legacyStateName.MatchString(e.Name()) {
+                continue
+            }
+            b, err := os.ReadFile(filepath.Join(d, e.Name()))
+            if err != nil {
+                continue
+            }
+            var ls legacyState
+            if json.Unmarshal(b, &ls) != nil || ls.Comic.FilePath == "" {
+                continue
+            }
+            p := filepath.Clean(ls.Comic.FilePath)
+            base := filepath.Base(p)
+            index[base] = append(index[base], legacyIndexEntry{p, strings.TrimSuffix(e.Name(), ".json")})
+        }
+    }
+    writeLegacyIndex(index)
+    return index
+}
+
+func writeLegacyIndex(index map[string][]legacyIndexEntry) {
+    data, err := json.Marshal(index)
+    if err != nil {
+        return
+    }
+    p, err := cachePath()
+    if err != nil {
+        return
+    }
+    writeStateFile(p, LEGACY_INDEX_FN, string(data))
+}
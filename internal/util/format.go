@@ -0,0 +1,192 @@
+package util
+
+import (
+    "bytes"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "io"
+    "os"
+    "path/filepath"
+    "strconv"
+    "strings"
+)
+
+// The kind of container a cbx is, going by its contents
+type ArchiveFormat int
+
+const (
+    FORMAT_UNKNOWN ArchiveFormat = iota
+    FORMAT_ZIP
+    FORMAT_RAR
+    FORMAT_7Z
+    FORMAT_TAR
+    FORMAT_PDF
+    FORMAT_DIR
+    FORMAT_EPUB
+)
+
+func (f ArchiveFormat) String() string {
+    switch f {
+    case FORMAT_ZIP:
+        return "zip"
+    case FORMAT_RAR:
+        return "rar"
+    case FORMAT_7Z:
+        return "7z"
+    case FORMAT_TAR:
+        return "tar"
+    case FORMAT_PDF:
+        return "pdf"
+    case FORMAT_DIR:
+        return "directory"
+    case FORMAT_EPUB:
+        return "epub"
+    }
+    return "unknown"
+}
+
+var ErrUnknownFormat = errors.New("not a recognized cbx format")
+
+// Returned when a cbx can't be opened, Format is what the file
+// actually is, which isn't necessarily what its extension says
+type OpenError struct {
+    Path   string
+    Format ArchiveFormat
+    Err    error
+}
+
+func (e *OpenError) Error() string {
+    name := filepath.Base(e.Path)
+    if e.Format == FORMAT_UNKNOWN {
+        return fmt.Sprintf("%s is %s", name, e.Err)
+    }
+
+    var mislabeled string
+    extFormat := formatForExt(filepath.Ext(e.Path))
+    if extFormat != FORMAT_UNKNOWN && extFormat != e.Format {
+        mislabeled = fmt.Sprintf(" (named like a %s)", extFormat)
+    }
+    return fmt.Sprintf("%s is a %s file%s that couldn't be read; %s",
+        name, e.Format, mislabeled, e.Err)
+}
+
+func (e *OpenError) Unwrap() error {
+    return e.Err
+}
+
+func formatForExt(ext string) ArchiveFormat {
+    switch strings.ToLower(ext) {
+    case ".cbz", ".zip":
+        return FORMAT_ZIP
+    case ".cbr", ".rar":
+        return FORMAT_RAR
+    case ".cb7", ".7z":
+        return FORMAT_7Z
+    case ".cbt", ".tar":
+        return FORMAT_TAR
+    case ".pdf":
+        return FORMAT_PDF
+    case ".epub":
+        return FORMAT_EPUB
+    }
+    return FORMAT_UNKNOWN
+}
+
+var (
+    zipMagic      = []byte("PK\x03\x04")
+    zipEmptyMagic = []byte("PK\x05\x06")
+    rarMagic      = []byte("Rar!\x1a\x07")
+    sevenZipMagic = []byte("7z\xbc\xaf\x27\x1c")
+    pdfMagic      = []byte("%PDF-")
+    tarMagic      = []byte("ustar")
+    epubMimetype  = []byte("application/epub+zip")
+)
+
+// The size of a tar header block
+const TAR_BLOCK_SIZE = 512
+
+// Work out what a cbx is from the first few bytes of it, rather
+// than trusting its extension
+func SniffFormat(filePath string) (ArchiveFormat, error) {
+    if IsDir(filePath) {
+        return FORMAT_DIR, nil
+    }
+
+    f, err := os.Open(filePath)
+    if err != nil {
+        return FORMAT_UNKNOWN, err
+    }
+    defer f.Close()
+
+    // Pdf allows junk before the header, within the first 1k
+    buf := make([]byte, 1024)
+    n, err := io.ReadFull(f, buf)
+    if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+        return FORMAT_UNKNOWN, err
+    }
+    buf = buf[:n]
+
+    return sniffFormat(buf), nil
+}
+
+func sniffFormat(buf []byte) ArchiveFormat {
+    switch {
+    case isEpubHeader(buf):
+        return FORMAT_EPUB
+    case bytes.HasPrefix(buf, zipMagic), bytes.HasPrefix(buf, zipEmptyMagic):
+        return FORMAT_ZIP
+    case bytes.HasPrefix(buf, rarMagic):
+        return FORMAT_RAR
+    case bytes.HasPrefix(buf, sevenZipMagic):
+        return FORMAT_7Z
+    case bytes.Contains(buf, pdfMagic):
+        return FORMAT_PDF
+    case isTarHeader(buf):
+        return FORMAT_TAR
+    }
+    return FORMAT_UNKNOWN
+}
+
+// An epub is a zip whose first entry is an uncompressed file
+// named mimetype, holding the epub mimetype
+func isEpubHeader(buf []byte) bool {
+    if !bytes.HasPrefix(buf, zipMagic) || len(buf) < 30 {
+        return false
+    }
+    nameLen := int(binary.LittleEndian.Uint16(buf[26:28]))
+    extraLen := int(binary.LittleEndian.Uint16(buf[28:30]))
+    data := 30 + nameLen + extraLen
+    if data > len(buf) || string(buf[30:30+nameLen]) != "mimetype" {
+        return false
+    }
+    return bytes.HasPrefix(buf[data:], epubMimetype)
+}
+
+// Posix and gnu tars have a magic number in the header, ancient ones
+// only have the header checksum to go on
+func isTarHeader(buf []byte) bool {
+    if len(buf) < TAR_BLOCK_SIZE {
+        return false
+    }
+    hdr := buf[:TAR_BLOCK_SIZE]
+    if bytes.Equal(hdr[257:262], tarMagic) {
+        return true
+    }
+
+    // The checksum is the sum of the header bytes with the
+    // checksum field itself counted as spaces
+    field := strings.Trim(string(hdr[148:156]), " \x00")
+    chksum, err := strconv.ParseInt(field, 8, 64)
+    if err != nil {
+        return false
+    }
+    var sum int64
+    for i, b := range hdr {
+        if i >= 148 && i < 156 {
+            b = ' '
+        }
+        sum += int64(b)
+    }
+    return sum == chksum
+}
@@ -2,6 +2,8 @@ package util
 
 import (
     "fmt"
+    "image"
+    "os"
 
 	"github.com/gotk3/gotk3/gdk"
 	"github.com/gotk3/gotk3/glib"
@@ -12,13 +14,154 @@ type Img = gdk.Pixbuf
 type ImgFormat = gdk.PixbufFormat
 
 func ImgNewFromFile(path string) (*Img, error) {
-    return gdk.PixbufNewFromFile(path)
+    b, err := os.ReadFile(path)
+    if err != nil {
+        return nil, err
+    }
+    return ImgNewFromBytes(b)
 }
 
 func ImgGetFileInfo(path string) (*ImgFormat, int, int, error) {
     return gdk.PixbufGetFileInfo(path)
 }
 
+// The decoder chain, see DecodeImage. When neither gdk nor go can read
+// an image both their errors are returned. Jpegs come back the way up
+// their exif says, see JpegOrientation
+func ImgNewFromBytes(data []byte) (*Img, error) {
+    p, err := imgDecode(data)
+    if err != nil {
+        return nil, err
+    }
+    return imgOrient(p, JpegOrientation(data))
+}
+
+func imgDecode(data []byte) (*Img, error) {
+    var gdkErr error
+    if !IsCMYKJpeg(data) {
+        p, err := gdk.PixbufNewFromBytesOnly(data)
+        if err == nil {
+            return p, nil
+        }
+        gdkErr = err
+    }
+
+    img, err := DecodeImage(data)
+    if err != nil {
+        if gdkErr != nil {
+            return nil, fmt.Errorf("%s; %s", gdkErr, err)
+        }
+        return nil, err
+    }
+    return ImgNewFromImage(img)
+}
+
+// Turns p from the way it was stored to the way up orientation says
+func imgOrient(p *Img, orientation int) (*Img, error) {
+    switch orientation {
+    case ORIENTATION_FLIP_H:
+        return p.Flip(true)
+    case ORIENTATION_ROTATE_180:
+        return p.RotateSimple(gdk.PIXBUF_ROTATE_UPSIDEDOWN)
+    case ORIENTATION_FLIP_V:
+        return p.Flip(false)
+    case ORIENTATION_TRANSPOSE:
+        r, err := p.RotateSimple(gdk.PIXBUF_ROTATE_CLOCKWISE)
+        if err != nil {
+            return nil, err
+        }
+        return r.Flip(true)
+    case ORIENTATION_ROTATE_CW:
+        return p.RotateSimple(gdk.PIXBUF_ROTATE_CLOCKWISE)
+    case ORIENTATION_TRANSVERSE:
+        r, err := p.RotateSimple(gdk.PIXBUF_ROTATE_COUNTERCLOCKWISE)
+        if err != nil {
+            return nil, err
+        }
+        return r.Flip(true)
+    case ORIENTATION_ROTATE_CCW:
+        return p.RotateSimple(gdk.PIXBUF_ROTATE_COUNTERCLOCKWISE)
+    }
+    return p, nil
+}
+
+// Turns p degrees clockwise, in steps of 90
+func ImgRotate(p *Img, degrees int) (*Img, error) {
+    switch ((degrees % 360) + 360) % 360 {
+    case 90:
+        return p.RotateSimple(gdk.PIXBUF_ROTATE_CLOCKWISE)
+    case 180:
+        return p.RotateSimple(gdk.PIXBUF_ROTATE_UPSIDEDOWN)
+    case 270:
+        return p.RotateSimple(gdk.PIXBUF_ROTATE_COUNTERCLOCKWISE)
+    }
+    return p, nil
+}
+
+// The crop for p's content, see ContentBounds
+func ImgContentBounds(p *Img) Crop {
+    return ContentBounds(p.GetPixels(), p.GetRowstride(), p.GetNChannels(),
+        p.GetWidth(), p.GetHeight())
+}
+
+// A copy of what's left of p once it's cropped
+func ImgCrop(p *Img, c Crop) (*Img, error) {
+    r := c.Rect(p.GetWidth(), p.GetHeight())
+    if r.Dx() == p.GetWidth() && r.Dy() == p.GetHeight() {
+        return p, nil
+    }
+    d, err := gdk.PixbufNew(p.GetColorspace(), p.GetHasAlpha(), p.GetBitsPerSample(), r.Dx(), r.Dy())
+    if err != nil {
+        return nil, err
+    }
+    // Gotk3 has no copy_area, a scale of 1 is the same thing
+    p.Scale(d, 0, 0, r.Dx(), r.Dy(), float64(-r.Min.X), float64(-r.Min.Y), 1, 1, gdk.INTERP_NEAREST)
+    return d, nil
+}
+
+// p scaled to w by h by gdk, bilinear or hyper. Lanczos isn't done
+// here, it's done in go off the ui thread, see ScaleLanczos
+func ImgScale(p *Img, w int, h int, filter ScaleFilter) (*Img, error) {
+    if filter == FILTER_BILINEAR {
+        return p.ScaleSimple(w, h, gdk.INTERP_BILINEAR)
+    }
+    return p.ScaleSimple(w, h, gdk.INTERP_HYPER)
+}
+
+// Copies a go image into a new pixbuf
+func ImgNewFromImage(img image.Image) (*Img, error) {
+    n := toNRGBA(img)
+    return imgNewFromPix(n.Pix[n.PixOffset(n.Rect.Min.X, n.Rect.Min.Y):], n.Stride,
+        n.Rect.Dx(), n.Rect.Dy())
+}
+
+// Copies a go image into a new pixbuf, the image must be opaque, gdk
+// doesn't premultiply alpha
+func ImgNewFromRGBA(img *image.RGBA) (*Img, error) {
+    return imgNewFromPix(img.Pix[img.PixOffset(img.Rect.Min.X, img.Rect.Min.Y):], img.Stride,
+        img.Rect.Dx(), img.Rect.Dy())
+}
+
+// Row by row since the pixbuf's rows may be padded
+func imgNewFromPix(pix []byte, srcStride int, w int, h int) (*Img, error) {
+    p, err := gdk.PixbufNew(gdk.COLORSPACE_RGB, true, 8, w, h)
+    if err != nil {
+        return nil, err
+    }
+    pixels := p.GetPixels()
+    stride := p.GetRowstride()
+    for y := 0; y < h; y++ {
+        row := pix[y*srcStride : y*srcStride+w*4]
+        copy(pixels[y*stride:], row)
+    }
+    return p, nil
+}
+
+// A page saying it's broken, in place of one that couldn't be loaded
+func ImgNewBrokenPage(w int, h int, msg string) (*Img, error) {
+    return ImgNewFromRGBA(DrawPlaceholder(w, h, BROKEN_PAGE_BG, msg))
+}
+
 func CreateLabel(text string, cssClass string, toolTip *string) *gtk.Label {
     c, err := gtk.LabelNew(text)
     if err != nil {
@@ -0,0 +1,126 @@
+package util
+
+import (
+    "errors"
+    "fmt"
+    "io"
+    "path"
+    "strings"
+)
+
+/*
+ * Archives come from anywhere, so what one may contain is limited to
+ * keep a malicious one, (a zip bomb, a few million empty entries), from
+ * using up all the memory or disk. A limit of 0 is no limit.
+ *
+ * Sizes are checked against what the archive declares when it's opened
+ * and again against what's actually read, since declared sizes can lie.
+ */
+type Limits struct {
+    // Entries in the archive
+    MaxEntries int `json:"maxEntries"`
+
+    // Uncompressed size of any one entry, in bytes
+    MaxEntrySize int64 `json:"maxEntrySize"`
+
+    // Uncompressed size of all the entries together, in bytes
+    MaxTotalSize int64 `json:"maxTotalSize"`
+
+    // Uncompressed to compressed size of any one entry
+    MaxRatio float64 `json:"maxRatio"`
+}
+
+var DefaultLimits = Limits{
+    MaxEntries:   10000,
+    MaxEntrySize: 256 << 20,
+    MaxTotalSize: 8 << 30,
+    MaxRatio:     100,
+}
+
+// Entries smaller than this aren't held to MaxRatio, a small file of
+// one color compresses very well without being a bomb
+const MIN_RATIO_CHECK_SIZE = 1 << 20
+
+var ErrLimitExceeded = errors.New("archive exceeds the limits in settings")
+var ErrUnsafeEntry = errors.New("unsafe entry")
+
+// Keeps the running totals while a source indexes an archive
+type entryCheck struct {
+    limits Limits
+    count  int
+    total  int64
+}
+
+// Size is the uncompressed size of the entry, compressed is 0 when
+// the archive doesn't say
+func (c *entryCheck) add(name string, size int64, compressed int64) error {
+    l := c.limits
+    c.count++
+    c.total += size
+    if l.MaxEntries > 0 && c.count > l.MaxEntries {
+        return fmt.Errorf("%w; more than %d entries (maxEntries)", ErrLimitExceeded, l.MaxEntries)
+    }
+    if l.MaxEntrySize > 0 && size > l.MaxEntrySize {
+        return fmt.Errorf("%w; %s is %s, more than %s (maxEntrySize)",
+            ErrLimitExceeded, name, byteSize(size), byteSize(l.MaxEntrySize))
+    }
+    if l.MaxTotalSize > 0 && c.total > l.MaxTotalSize {
+        return fmt.Errorf("%w; more than %s uncompressed (maxTotalSize)",
+            ErrLimitExceeded, byteSize(l.MaxTotalSize))
+    }
+    if l.MaxRatio > 0 && compressed > 0 && size >= MIN_RATIO_CHECK_SIZE &&
+        float64(size)/float64(compressed) > l.MaxRatio {
+        return fmt.Errorf("%w; %s compresses %.0f to 1, more than %.0f to 1 (maxRatio)",
+            ErrLimitExceeded, name, float64(size)/float64(compressed), l.MaxRatio)
+    }
+    return nil
+}
+
+// Read all of r, failing once it's read more than max bytes
+func readAllLimited(r io.Reader, name string, max int64) ([]byte, error) {
+    if max <= 0 {
+        return io.ReadAll(r)
+    }
+    b, err := io.ReadAll(io.LimitReader(r, max+1))
+    if err != nil {
+        return nil, err
+    }
+    if int64(len(b)) > max {
+        return nil, fmt.Errorf("%w; %s is more than %s (maxEntrySize)",
+            ErrLimitExceeded, name, byteSize(max))
+    }
+    return b, nil
+}
+
+/*
+ * Entry names become paths when they're kept on disk, so any name
+ * that could land outside the tmp dir is refused. That's absolute
+ * paths, windows drive and unc paths, and anything that climbs out
+ * with .. once cleaned.
+ */
+func checkEntryName(name string) error {
+    n := strings.ReplaceAll(name, "\\", "/")
+    if n == "" || strings.ContainsRune(n, 0) {
+        return fmt.Errorf("%w; bad name %q", ErrUnsafeEntry, name)
+    }
+    if strings.HasPrefix(n, "/") || (len(n) > 1 && n[1] == ':') {
+        return fmt.Errorf("%w; absolute path %q", ErrUnsafeEntry, name)
+    }
+    c := path.Clean(n)
+    if c == ".." || strings.HasPrefix(c, "../") {
+        return fmt.Errorf("%w; path %q leaves the archive", ErrUnsafeEntry, name)
+    }
+    return nil
+}
+
+func byteSize(n int64) string {
+    switch {
+    case n >= 1<<30:
+        return fmt.Sprintf("%.1fGiB", float64(n)/(1<<30))
+    case n >= 1<<20:
+        return fmt.Sprintf("%.1fMiB", float64(n)/(1<<20))
+    case n >= 1<<10:
+        return fmt.Sprintf("%.1fKiB", float64(n)/(1<<10))
+    }
+    return fmt.Sprintf("%dB", n)
+}
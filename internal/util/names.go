@@ -0,0 +1,147 @@
+package util
+
+import (
+    "archive/zip"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+
+    "golang.org/x/text/encoding"
+    "golang.org/x/text/encoding/charmap"
+    "golang.org/x/text/encoding/japanese"
+)
+
+/*
+ * Zip entry names are meant to be cp437 unless the entry's utf-8 flag is
+ * set, but plenty of zips are made with whatever the tool's locale was,
+ * and manga in particular is often zipped with shift-jis names. Names
+ * without the flag are decoded going by what they look like, unless the
+ * user has said what they are, see NameEncoding in the layout.
+ */
+type NameEncoding string
+
+const (
+    NAME_ENCODING_AUTO      NameEncoding = ""
+    NAME_ENCODING_UTF8      NameEncoding = "utf-8"
+    NAME_ENCODING_SHIFT_JIS NameEncoding = "shift_jis"
+    NAME_ENCODING_CP437     NameEncoding = "cp437"
+)
+
+var NameEncodings = []NameEncoding{
+    NAME_ENCODING_AUTO,
+    NAME_ENCODING_UTF8,
+    NAME_ENCODING_SHIFT_JIS,
+    NAME_ENCODING_CP437,
+}
+
+func (e NameEncoding) String() string {
+    switch e {
+    case NAME_ENCODING_UTF8:
+        return "UTF-8"
+    case NAME_ENCODING_SHIFT_JIS:
+        return "Shift-JIS"
+    case NAME_ENCODING_CP437:
+        return "CP437 (DOS)"
+    }
+    return "Automatic"
+}
+
+func (e NameEncoding) encoding() encoding.Encoding {
+    switch e {
+    case NAME_ENCODING_SHIFT_JIS:
+        return japanese.ShiftJIS
+    case NAME_ENCODING_CP437:
+        return charmap.CodePage437
+    }
+    return nil
+}
+
+// Utf-8 if every name is, shift-jis if every name decodes cleanly as
+// shift-jis and some of it is actually japanese, otherwise cp437, which
+// is what the zip spec says and can decode anything
+func detectNameEncoding(names []string) NameEncoding {
+    utf8Names := true
+    for _, n := range names {
+        if !utf8.ValidString(n) {
+            utf8Names = false
+            break
+        }
+    }
+    if utf8Names {
+        return NAME_ENCODING_UTF8
+    }
+
+    japaneseNames := false
+    for _, n := range names {
+        d, err := japanese.ShiftJIS.NewDecoder().String(n)
+        if err != nil || strings.ContainsRune(d, utf8.RuneError) {
+            return NAME_ENCODING_CP437
+        }
+        if !japaneseNames {
+            japaneseNames = hasJapanese(d)
+        }
+    }
+    if japaneseNames {
+        return NAME_ENCODING_SHIFT_JIS
+    }
+    return NAME_ENCODING_CP437
+}
+
+// Half width katakana doesn't count, it's what cp437's accented
+// letters look like in shift-jis
+func hasJapanese(s string) bool {
+    for _, r := range s {
+        if r >= 0xff00 {
+            continue
+        }
+        if unicode.In(r, unicode.Hiragana, unicode.Katakana, unicode.Han) {
+            return true
+        }
+    }
+    return false
+}
+
+// The encoding a zip's names are decoded with, enc unless it's auto
+func zipNameEncoding(files []*zip.File, enc NameEncoding) NameEncoding {
+    if enc != NAME_ENCODING_AUTO {
+        return enc
+    }
+    var raw []string
+    for _, f := range files {
+        if f.NonUTF8 {
+            raw = append(raw, f.Name)
+        }
+    }
+    return detectNameEncoding(raw)
+}
+
+// What the entries of src would be called if their names were decoded
+// with enc instead, by the entry each name was read from. Only zips
+// have names to decode, there's nothing to rename for anything else
+func RenamedEntries(src PageSource, enc NameEncoding) map[string]string {
+    s, ok := src.(*zipSource)
+    if !ok {
+        return nil
+    }
+    enc = zipNameEncoding(s.r.File, enc)
+    names := make(map[string]string)
+    for name, f := range s.files {
+        if f.NonUTF8 {
+            names[name] = decodeName(f.Name, enc)
+        }
+    }
+    return names
+}
+
+// Names that can't be decoded are left as they are
+func decodeName(name string, enc NameEncoding) string {
+    e := enc.encoding()
+    if e == nil {
+        return name
+    }
+    d, err := e.NewDecoder().String(name)
+    if err != nil {
+        return name
+    }
+    return d
+}
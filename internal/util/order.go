@@ -0,0 +1,200 @@
+package util
+
+import (
+    "path"
+    "path/filepath"
+    "sort"
+    "strings"
+    "unicode"
+    "unicode/utf8"
+)
+
+// Compare two strings the way a person would, runs of digits are
+// compared by their numeric value so p2 comes before p10 and
+// letters are compared without regard to case
+func NaturalLess(a, b string) bool {
+    i, j := 0, 0
+    for i < len(a) && j < len(b) {
+        if isDigit(a[i]) && isDigit(b[j]) {
+            si, sj := i, j
+            for i < len(a) && isDigit(a[i]) {
+                i++
+            }
+            for j < len(b) && isDigit(b[j]) {
+                j++
+            }
+            na := strings.TrimLeft(a[si:i], "0")
+            nb := strings.TrimLeft(b[sj:j], "0")
+            if len(na) != len(nb) {
+                return len(na) < len(nb)
+            }
+            if na != nb {
+                return na < nb
+            }
+            // Same value, fewer leading zeros first
+            if i-si != j-sj {
+                return i-si < j-sj
+            }
+            continue
+        }
+
+        ra, wa := utf8.DecodeRuneInString(a[i:])
+        rb, wb := utf8.DecodeRuneInString(b[j:])
+        la, lb := unicode.ToLower(ra), unicode.ToLower(rb)
+        if la != lb {
+            return la < lb
+        }
+        i += wa
+        j += wb
+    }
+
+    if len(a)-i != len(b)-j {
+        return len(a)-i < len(b)-j
+    }
+
+    // Only differ by case, keep it stable
+    return a < b
+}
+
+func isDigit(c byte) bool {
+    return c >= '0' && c <= '9'
+}
+
+func SortNatural(s []string) {
+    sort.SliceStable(s, func(i, j int) bool {
+        return NaturalLess(s[i], s[j])
+    })
+}
+
+// Pages are ordered a directory at a time, so pages in one chapter
+// directory never interleave with those of another
+func pageLess(a, b string) bool {
+    da := filepath.Dir(a)
+    db := filepath.Dir(b)
+    if da != db {
+        return NaturalLess(da, db)
+    }
+    return NaturalLess(filepath.Base(a), filepath.Base(b))
+}
+
+/*
+ * The page ordering stage, turns the image paths found in a cbx
+ * in whatever order the archive had them, into reading order.
+ *
+ * Paths are put in natural order per directory. If there is a
+ * ComicInfo with a Pages list, the Image attributes are indexes
+ * into that natural order and the list itself is the reading order.
+ * Any image the list doesn't mention follows in natural order.
+ *
+ * As a side effect each ComicPageInfo is resolved to the path it
+ * describes, so page metadata can be matched up after reordering.
+ */
+func OrderPages(paths []string, ci *ComicInfo) []string {
+    natural := make([]string, len(paths))
+    copy(natural, paths)
+    sort.SliceStable(natural, func(i, j int) bool {
+        return pageLess(natural[i], natural[j])
+    })
+
+    if ci == nil || len(ci.Pages) == 0 {
+        return natural
+    }
+
+    ordered := make([]string, 0, len(natural))
+    used := make([]bool, len(natural))
+    for i := range ci.Pages {
+        cp := &ci.Pages[i]
+        if cp.Image < 0 || cp.Image >= len(natural) {
+            continue
+        }
+        cp.Path = natural[cp.Image]
+        if used[cp.Image] {
+            continue
+        }
+        used[cp.Image] = true
+        ordered = append(ordered, natural[cp.Image])
+    }
+
+    for i := range natural {
+        if !used[i] {
+            ordered = append(ordered, natural[i])
+        }
+    }
+    return ordered
+}
+
+/*
+ * Before layout 0.3 and bookmarks 0.2 pages were files extracted into a
+ * tmp dir, TMP_CBXS_PREFIX and some random letters, kept in byte order
+ * of their paths there, and layouts saved those paths. Pages is the
+ * entry names of the pages now, in their order now.
+ */
+
+// The index in pages of each of saved, the paths of a pre 0.3 layout's
+// pages, -1 where it's gone. They're matched by the entry name in the
+// path, and only if none of them match, by where they were in the old
+// order, see LegacyPageOrder
+func MatchLegacyPages(pages []string, saved []string) []int {
+    names := make(map[string]int)
+    for i, n := range pages {
+        names[path.Clean(n)] = i
+    }
+    idxs := make([]int, len(saved))
+    matched := false
+    for i, p := range saved {
+        idxs[i] = -1
+        for _, n := range legacyEntryNames(p) {
+            if idx, ok := names[n]; ok {
+                idxs[i] = idx
+                matched = true
+                break
+            }
+        }
+    }
+    if matched {
+        return idxs
+    }
+
+    order := LegacyPageOrder(pages)
+    for i := range idxs {
+        if i < len(order) {
+            idxs[i] = order[i]
+        }
+    }
+    return idxs
+}
+
+// Maps an index in the old order to the index in pages. Only entries
+// with an extension that was read then were pages, so ones that have
+// been added since don't move the rest
+func LegacyPageOrder(pages []string) []int {
+    var legacy []string
+    names := make(map[string]int)
+    for i, n := range pages {
+        if !legacyImageExt(strings.ToLower(filepath.Ext(n))) {
+            continue
+        }
+        legacy = append(legacy, n)
+        names[n] = i
+    }
+    sort.Strings(legacy)
+
+    idxs := make([]int, len(legacy))
+    for i := range legacy {
+        idxs[i] = names[legacy[i]]
+    }
+    return idxs
+}
+
+// The entry names a page path saved before layout 0.3 could have, what
+// follows each dir in it that could be the tmp dir
+func legacyEntryNames(p string) []string {
+    var names []string
+    parts := strings.Split(strings.ReplaceAll(p, "\\", "/"), "/")
+    for i := 0; i < len(parts)-1; i++ {
+        if strings.HasPrefix(parts[i], TMP_CBXS_PREFIX) {
+            names = append(names, path.Clean(strings.Join(parts[i+1:], "/")))
+        }
+    }
+    return names
+}
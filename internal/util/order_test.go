@@ -0,0 +1,59 @@
+package util
+
+import (
+    "encoding/json"
+    "reflect"
+    "testing"
+)
+
+// Pages as a 0.1 layout saved them, the path each was extracted to
+const testLegacyLayout = `{
+    "formatVersion": "0.1",
+    "comic": {"hash": "041f8969b75f95c9175d01675e668668", "filePath": "issue1.cbz"},
+    "pages": [
+        {"filePath": "/tmp/cbxv-xkcdqz/issue1/p01.jpg", "width": 800, "height": 1200, "span": 0},
+        {"filePath": "/tmp/cbxv-xkcdqz/issue1/p02.jpg", "width": 1600, "height": 1200, "span": 1},
+        {"filePath": "/tmp/cbxv-xkcdqz/issue1/p03.png", "width": 800, "height": 1200, "span": 0, "hidden": true}
+    ]
+}`
+
+func TestMatchLegacyPages(t *testing.T) {
+    var lo struct {
+        Pages []struct {
+            FilePath string `json:"filePath"`
+        } `json:"pages"`
+    }
+    if err := json.Unmarshal([]byte(testLegacyLayout), &lo); err != nil {
+        t.Fatal(err)
+    }
+    var saved []string
+    for _, p := range lo.Pages {
+        saved = append(saved, p.FilePath)
+    }
+
+    tests := []struct {
+        name  string
+        pages []string
+        saved []string
+        want  []int
+    }{
+        // Pages that weren't pages before, in among the old ones
+        {"new pages", []string{"issue1/cover.jxl", "issue1/p01.jpg", "issue1/p02.jpg",
+            "issue1/p02b.tiff", "issue1/p03.png"}, saved, []int{1, 2, 4}},
+        {"page gone", []string{"issue1/p01.jpg", "issue1/p03.png"}, saved, []int{0, -1, 1}},
+        {"tmp dir in tmp dir", []string{"p01.jpg"},
+            []string{"/home/me/cbxv-tmp/cbxv-abcdef/p01.jpg"}, []int{0}},
+        // Nothing matches by name, so it's the old order, without the
+        // .jxl that wasn't a page then
+        {"by order", []string{"b.jpg", "a.jpg", "a0.jxl", "c.png"},
+            []string{"x", "y", "z", "w"}, []int{1, 0, 3, -1}},
+    }
+    for _, tt := range tests {
+        t.Run(tt.name, func(t *testing.T) {
+            got := MatchLegacyPages(tt.pages, tt.saved)
+            if !reflect.DeepEqual(got, tt.want) {
+                t.Fatalf("got %v, want %v", got, tt.want)
+            }
+        })
+    }
+}
@@ -0,0 +1,77 @@
+package util
+
+import (
+    "encoding/json"
+    "errors"
+    "fmt"
+    "io/fs"
+    "os"
+    "path/filepath"
+)
+
+const PASSWORDS_DN string = "passwords"
+
+var ErrPasswordRequired = errors.New("password required")
+var ErrBadPassword = errors.New("wrong password")
+
+type storedPassword struct {
+    Password string `json:"password"`
+}
+
+func passwordsPath() (string, error) {
+    p, err := dataPath()
+    if err != nil {
+        return p, err
+    }
+    return filepath.Join(p, PASSWORDS_DN), nil
+}
+
+/*
+ * Remembered passwords are kept by fingerprint, in plain text, in a
+ * dir only the user can read. It's a convenience for comics the user
+ * already has the password to, not a keyring.
+ */
+func WritePassword(hash string, password string) error {
+    p, err := passwordsPath()
+    if err != nil {
+        return err
+    }
+    b, err := json.Marshal(storedPassword{password})
+    if err != nil {
+        return err
+    }
+    return writeStateFile(p, fmt.Sprintf("%s.json", hash), string(b))
+}
+
+// Empty and no error when nothing's remembered for hash
+func ReadPassword(hash string) (string, error) {
+    p, err := passwordsPath()
+    if err != nil {
+        return "", err
+    }
+    b, err := os.ReadFile(filepath.Join(p, fmt.Sprintf("%s.json", hash)))
+    if err != nil {
+        if errors.Is(err, fs.ErrNotExist) {
+            return "", nil
+        }
+        return "", err
+    }
+    var sp storedPassword
+    err = json.Unmarshal(b, &sp)
+    if err != nil {
+        return "", err
+    }
+    return sp.Password, nil
+}
+
+func ForgetPassword(hash string) error {
+    p, err := passwordsPath()
+    if err != nil {
+        return err
+    }
+    err = os.Remove(filepath.Join(p, fmt.Sprintf("%s.json", hash)))
+    if errors.Is(err, fs.ErrNotExist) {
+        return nil
+    }
+    return err
+}
@@ -0,0 +1,525 @@
+package util
+
+import (
+    "bytes"
+    "fmt"
+    "image"
+    _ "image/jpeg"
+    "image/png"
+    "io"
+    "os"
+    "path/filepath"
+    "sort"
+    "strconv"
+    "strings"
+    "sync"
+
+    "github.com/pdfcpu/pdfcpu/pkg/api"
+    "github.com/pdfcpu/pdfcpu/pkg/pdfcpu"
+    pdfmodel "github.com/pdfcpu/pdfcpu/pkg/pdfcpu/model"
+    "github.com/pdfcpu/pdfcpu/pkg/pdfcpu/types"
+    "golang.org/x/image/draw"
+    _ "golang.org/x/image/tiff"
+)
+
+// Resolution placeholder pages are drawn at
+const PDF_PLACEHOLDER_DPI = 100
+
+// Largest side of a composited page, in pixels
+const PDF_MAX_PAGE_PX = 8192
+
+/*
+ * Every pdf page is one entry, named for the pdf and the page number
+ * zero padded, so they sort in document order.
+ *
+ * A page with one image is that image as stored, when it's a type we
+ * can pass through. A page with several images has them composited
+ * where the page draws them. A page with no images, ie. vector art or
+ * text, is a placeholder saying so, so the page count and spreads
+ * still line up with the document.
+ */
+type pdfSource struct {
+    mu      sync.Mutex
+    f       *os.File
+    ctx     *pdfmodel.Context
+    entries []string
+    pages   map[string]*pdfPage
+}
+
+type pdfPage struct {
+    pageNr int
+    images []pdfImage
+}
+
+type pdfImage struct {
+    objNr   int
+    resName string
+    ext     string
+}
+
+// Before layout 0.3 the pages of a pdf were the images pdfcpu extracted
+// from it, named by pdfcpu and as many as it has images, so nothing
+// saved then says anything about its pages now
+func IsPdfSource(src PageSource) bool {
+    _, ok := src.(*pdfSource)
+    return ok
+}
+
+func openPdfSource(filePath string, limits Limits) (*pdfSource, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return nil, err
+    }
+
+    conf := pdfmodel.NewDefaultConfiguration()
+    conf.Cmd = pdfmodel.EXTRACTIMAGES
+    ctx, err := api.ReadValidateAndOptimize(f, conf)
+    if err != nil {
+        f.Close()
+        return nil, err
+    }
+
+    if limits.MaxEntries > 0 && ctx.PageCount > limits.MaxEntries {
+        f.Close()
+        return nil, fmt.Errorf("%w; more than %d pages (maxEntries)", ErrLimitExceeded, limits.MaxEntries)
+    }
+
+    s := &pdfSource{f: f, ctx: ctx, pages: make(map[string]*pdfPage)}
+    base := strings.TrimSuffix(filepath.Base(filePath), filepath.Ext(filePath))
+    digits := len(strconv.Itoa(ctx.PageCount))
+    for pageNr := 1; pageNr <= ctx.PageCount; pageNr++ {
+        pg := &pdfPage{pageNr: pageNr}
+        objNrs := pdfcpu.ImageObjNrs(ctx, pageNr)
+        sort.Ints(objNrs)
+        for _, objNr := range objNrs {
+            imgObj := ctx.Optimize.ImageObjects[objNr]
+            res := imgObj.ResourceNames[pageNr-1]
+
+            // A stub is just the image's metadata
+            stub, err := pdfcpu.ExtractImage(ctx, imgObj.ImageDict, false, res, objNr, true)
+            if err != nil || stub == nil {
+                continue
+            }
+            pg.images = append(pg.images, pdfImage{objNr, res, pdfImageExt(stub.Filter)})
+        }
+
+        // Only a lone jpeg is passed through, everything else is
+        // converted or drawn
+        ext := ".png"
+        if len(pg.images) == 1 && pg.images[0].ext == ".jpg" {
+            ext = ".jpg"
+        }
+        name := fmt.Sprintf("%s_%0*d%s", base, digits, pageNr, ext)
+        s.entries = append(s.entries, name)
+        s.pages[name] = pg
+    }
+    return s, nil
+}
+
+// The type pdfcpu will render an image as, going by its filters
+func pdfImageExt(filters string) string {
+    if strings.Contains(filters, "DCTDecode") {
+        return ".jpg"
+    } else if strings.Contains(filters, "JPXDecode") {
+        return ".jpx"
+    } else if strings.Contains(filters, "CCITTFaxDecode") {
+        return ".tif"
+    }
+    return ".png"
+}
+
+func (s *pdfSource) Entries() []string {
+    return s.entries
+}
+
+func (s *pdfSource) ReadEntry(name string) ([]byte, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    pg, ok := s.pages[name]
+    if !ok {
+        return nil, fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+    }
+
+    if len(pg.images) == 0 {
+        return s.placeholder(pg)
+    }
+
+    if len(pg.images) == 1 {
+        b, err := s.extract(pg.pageNr, pg.images[0])
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+        if pg.images[0].ext == ".jpg" || pg.images[0].ext == ".png" {
+            return b, nil
+        }
+        img, _, err := image.Decode(bytes.NewReader(b))
+        if err != nil {
+            return nil, fmt.Errorf("%s: %w", name, err)
+        }
+        return encodePng(img)
+    }
+
+    img, err := s.composite(pg)
+    if err != nil {
+        return nil, fmt.Errorf("%s: %w", name, err)
+    }
+    return encodePng(img)
+}
+
+func (s *pdfSource) OpenEntry(name string) (io.ReadCloser, error) {
+    b, err := s.ReadEntry(name)
+    if err != nil {
+        return nil, err
+    }
+    return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *pdfSource) Close() error {
+    return s.f.Close()
+}
+
+func (s *pdfSource) extract(pageNr int, pi pdfImage) ([]byte, error) {
+    imgObj := s.ctx.Optimize.ImageObjects[pi.objNr]
+    img, err := pdfcpu.ExtractImage(s.ctx, imgObj.ImageDict, false, pi.resName, pi.objNr, false)
+    if err != nil {
+        return nil, err
+    }
+    if img == nil || img.Reader == nil {
+        return nil, fmt.Errorf("page %d, %s: unsupported image", pageNr, pi.resName)
+    }
+    return io.ReadAll(img)
+}
+
+// The visible area of the page in pdf units, (points)
+func (s *pdfSource) pageBox(pageNr int) (*types.Rectangle, []byte) {
+    d, _, attrs, err := s.ctx.PageDict(pageNr, false)
+    if err != nil || attrs == nil {
+        return types.RectForFormat("A4"), nil
+    }
+    box := attrs.MediaBox
+    if attrs.CropBox != nil {
+        box = attrs.CropBox
+    }
+    if box == nil {
+        box = types.RectForFormat("A4")
+    }
+    content, _ := s.ctx.PageContent(d, pageNr)
+    return box, content
+}
+
+/*
+ * Draw all the images of a page onto one canvas, at the resolution
+ * of the most detailed image. Where they go comes from the page's
+ * content stream, if that can't be worked out for every image they're
+ * stacked top to bottom instead, which is how scanners that split a
+ * page into strips lay them out anyway.
+ */
+func (s *pdfSource) composite(pg *pdfPage) (image.Image, error) {
+    var imgs []image.Image
+    var names []string
+    for _, pi := range pg.images {
+        b, err := s.extract(pg.pageNr, pi)
+        if err != nil {
+            fmt.Printf("Warning skipping image %s on page %d; %s\n", pi.resName, pg.pageNr, err)
+            continue
+        }
+        img, _, err := image.Decode(bytes.NewReader(b))
+        if err != nil {
+            fmt.Printf("Warning skipping image %s on page %d; %s\n", pi.resName, pg.pageNr, err)
+            continue
+        }
+        imgs = append(imgs, img)
+        names = append(names, pi.resName)
+    }
+    if len(imgs) == 0 {
+        return nil, fmt.Errorf("page %d: no readable images", pg.pageNr)
+    }
+
+    box, content := s.pageBox(pg.pageNr)
+    placements := imagePlacements(content)
+    rects := make([]pdfRect, len(imgs))
+    for i, n := range names {
+        m, ok := placements[n]
+        if !ok {
+            return stackImages(imgs), nil
+        }
+        rects[i] = m.bounds()
+        if rects[i].w() <= 0 || rects[i].h() <= 0 {
+            return stackImages(imgs), nil
+        }
+    }
+
+    // Pixels per point
+    var scale float64
+    for i, img := range imgs {
+        sx := float64(img.Bounds().Dx()) / rects[i].w()
+        if sx > scale {
+            scale = sx
+        }
+    }
+
+    // A tiny image drawn from a big one mustn't make a huge canvas
+    longest := box.Width()
+    if box.Height() > longest {
+        longest = box.Height()
+    }
+    if longest*scale > PDF_MAX_PAGE_PX {
+        scale = PDF_MAX_PAGE_PX / longest
+    }
+
+    w := int(box.Width()*scale + 0.5)
+    h := int(box.Height()*scale + 0.5)
+    if w <= 0 || h <= 0 {
+        return stackImages(imgs), nil
+    }
+    canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+    for i, img := range imgs {
+        r := rects[i]
+        // Pdf y goes up from the bottom
+        dst := image.Rect(
+            int((r.x0-box.LL.X)*scale+0.5),
+            int((box.UR.Y-r.y1)*scale+0.5),
+            int((r.x1-box.LL.X)*scale+0.5),
+            int((box.UR.Y-r.y0)*scale+0.5))
+        draw.BiLinear.Scale(canvas, dst, img, img.Bounds(), draw.Over, nil)
+    }
+    return canvas, nil
+}
+
+func stackImages(imgs []image.Image) image.Image {
+    var w, h int
+    for _, img := range imgs {
+        if img.Bounds().Dx() > w {
+            w = img.Bounds().Dx()
+        }
+        h += img.Bounds().Dy()
+    }
+
+    canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(canvas, canvas.Bounds(), image.White, image.Point{}, draw.Src)
+    y := 0
+    for _, img := range imgs {
+        b := img.Bounds()
+        x := (w - b.Dx()) / 2
+        draw.Draw(canvas, image.Rect(x, y, x+b.Dx(), y+b.Dy()), img, b.Min, draw.Over)
+        y += b.Dy()
+    }
+    return canvas
+}
+
+// A page the size of the pdf page with a note that it has no image
+func (s *pdfSource) placeholder(pg *pdfPage) ([]byte, error) {
+    box, _ := s.pageBox(pg.pageNr)
+    w := int(box.Width() * PDF_PLACEHOLDER_DPI / 72)
+    h := int(box.Height() * PDF_PLACEHOLDER_DPI / 72)
+    if w <= 0 || h <= 0 {
+        w, h = 827, 1169
+    }
+
+    msg := fmt.Sprintf("Page %d has no image to show", pg.pageNr)
+    canvas := DrawPlaceholder(w, h, PLACEHOLDER_BG, msg)
+    return encodePng(canvas)
+}
+
+func encodePng(img image.Image) ([]byte, error) {
+    var b bytes.Buffer
+    err := png.Encode(&b, img)
+    if err != nil {
+        return nil, err
+    }
+    return b.Bytes(), nil
+}
+
+type pdfRect struct {
+    x0, y0, x1, y1 float64
+}
+
+func (r pdfRect) w() float64 {
+    return r.x1 - r.x0
+}
+
+func (r pdfRect) h() float64 {
+    return r.y1 - r.y0
+}
+
+// A pdf transformation matrix [a b c d e f]
+type pdfMatrix [6]float64
+
+var pdfIdentity = pdfMatrix{1, 0, 0, 1, 0, 0}
+
+// m then n
+func (m pdfMatrix) mul(n pdfMatrix) pdfMatrix {
+    return pdfMatrix{
+        m[0]*n[0] + m[1]*n[2],
+        m[0]*n[1] + m[1]*n[3],
+        m[2]*n[0] + m[3]*n[2],
+        m[2]*n[1] + m[3]*n[3],
+        m[4]*n[0] + m[5]*n[2] + n[4],
+        m[4]*n[1] + m[5]*n[3] + n[5],
+    }
+}
+
+// Images are drawn into the unit square, so its corners through
+// the matrix are where the image ends up on the page
+func (m pdfMatrix) bounds() pdfRect {
+    r := pdfRect{m[4], m[5], m[4], m[5]}
+    for _, c := range [][2]float64{{1, 0}, {0, 1}, {1, 1}} {
+        x := m[0]*c[0] + m[2]*c[1] + m[4]
+        y := m[1]*c[0] + m[3]*c[1] + m[5]
+        if x < r.x0 {
+            r.x0 = x
+        }
+        if x > r.x1 {
+            r.x1 = x
+        }
+        if y < r.y0 {
+            r.y0 = y
+        }
+        if y > r.y1 {
+            r.y1 = y
+        }
+    }
+    return r
+}
+
+/*
+ * Follow the current transformation matrix through a content stream
+ * and note it wherever an xobject is drawn. Only q, Q, cm and Do
+ * matter, everything else is tokenized just enough to step over it.
+ * The first placement of each xobject wins.
+ */
+func imagePlacements(content []byte) map[string]pdfMatrix {
+    placements := make(map[string]pdfMatrix)
+    ctm := pdfIdentity
+    var stack []pdfMatrix
+    var operands []string
+
+    i := 0
+    for i < len(content) {
+        c := content[i]
+        switch {
+        case isPdfSpace(c):
+            i++
+        case c == '%':
+            for i < len(content) && content[i] != '\n' && content[i] != '\r' {
+                i++
+            }
+        case c == '(':
+            i = skipPdfString(content, i)
+            operands = append(operands, "")
+        case c == '<' && i+1 < len(content) && content[i+1] == '<':
+            i += 2
+        case c == '>' && i+1 < len(content) && content[i+1] == '>':
+            i += 2
+        case c == '<':
+            for i < len(content) && content[i] != '>' {
+                i++
+            }
+            i++
+            operands = append(operands, "")
+        case c == '[' || c == ']' || c == '{' || c == '}':
+            i++
+        case c == '/':
+            j := i + 1
+            for j < len(content) && !isPdfSpace(content[j]) && !isPdfDelim(content[j]) {
+                j++
+            }
+            operands = append(operands, string(content[i:j]))
+            i = j
+        default:
+            j := i
+            for j < len(content) && !isPdfSpace(content[j]) && !isPdfDelim(content[j]) {
+                j++
+            }
+            if j == i {
+                // A stray delimiter
+                j++
+            }
+            tok := string(content[i:j])
+            i = j
+            if _, err := strconv.ParseFloat(tok, 64); err == nil {
+                operands = append(operands, tok)
+                continue
+            }
+
+            switch tok {
+            case "q":
+                stack = append(stack, ctm)
+            case "Q":
+                if len(stack) > 0 {
+                    ctm = stack[len(stack)-1]
+                    stack = stack[:len(stack)-1]
+                }
+            case "cm":
+                if len(operands) >= 6 {
+                    var m pdfMatrix
+                    ok := true
+                    for k, op := range operands[len(operands)-6:] {
+                        v, err := strconv.ParseFloat(op, 64)
+                        if err != nil {
+                            ok = false
+                            break
+                        }
+                        m[k] = v
+                    }
+                    if ok {
+                        ctm = m.mul(ctm)
+                    }
+                }
+            case "Do":
+                if len(operands) > 0 && strings.HasPrefix(operands[len(operands)-1], "/") {
+                    name := operands[len(operands)-1][1:]
+                    if _, ok := placements[name]; !ok {
+                        placements[name] = ctm
+                    }
+                }
+            case "ID":
+                i = skipInlineImage(content, i)
+            }
+            operands = operands[:0]
+        }
+    }
+    return placements
+}
+
+func isPdfSpace(c byte) bool {
+    return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPdfDelim(c byte) bool {
+    return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// Strings nest balanced parens and can escape them
+func skipPdfString(content []byte, i int) int {
+    depth := 0
+    for i < len(content) {
+        switch content[i] {
+        case '\\':
+            i++
+        case '(':
+            depth++
+        case ')':
+            depth--
+            if depth == 0 {
+                return i + 1
+            }
+        }
+        i++
+    }
+    return i
+}
+
+// Inline image data is binary, it ends at whitespace EI whitespace
+func skipInlineImage(content []byte, i int) int {
+    for i+3 < len(content) {
+        if isPdfSpace(content[i]) && content[i+1] == 'E' && content[i+2] == 'I' &&
+            (isPdfSpace(content[i+3]) || i+3 == len(content)) {
+            return i + 3
+        }
+        i++
+    }
+    return len(content)
+}
@@ -0,0 +1,58 @@
+package util
+
+import (
+    "image"
+    "image/color"
+
+    "golang.org/x/image/draw"
+    "golang.org/x/image/font"
+    "golang.org/x/image/font/basicfont"
+    "golang.org/x/image/math/fixed"
+)
+
+// Placeholders for pages that have nothing to show, and for
+// pages that should but couldn't be read
+var PLACEHOLDER_BG = color.RGBA{0xe0, 0xe0, 0xe0, 0xff}
+var BROKEN_PAGE_BG = color.RGBA{0x4a, 0x20, 0x20, 0xff}
+
+// Size of a broken page when there's nothing better to go on
+const BROKEN_PAGE_W = 1000
+const BROKEN_PAGE_H = 1500
+
+// A w x h page of bg with msg written across the middle of it
+func DrawPlaceholder(w int, h int, bg color.RGBA, msg string) *image.RGBA {
+    canvas := image.NewRGBA(image.Rect(0, 0, w, h))
+    draw.Draw(canvas, canvas.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+
+    // Text that contrasts with the background
+    fg := color.RGBA{0x60, 0x60, 0x60, 0xff}
+    if int(bg.R)+int(bg.G)+int(bg.B) < 3*0x80 {
+        fg = color.RGBA{0xd0, 0xd0, 0xd0, 0xff}
+    }
+
+    // The built in font is tiny, draw the note small and blow it up
+    face := basicfont.Face7x13
+    tw := font.MeasureString(face, msg).Ceil()
+    th := face.Metrics().Height.Ceil()
+    if tw <= 0 {
+        return canvas
+    }
+    txt := image.NewRGBA(image.Rect(0, 0, tw, th))
+    d := font.Drawer{
+        Dst:  txt,
+        Src:  image.NewUniform(fg),
+        Face: face,
+        Dot:  fixed.P(0, face.Metrics().Ascent.Ceil()),
+    }
+    d.DrawString(msg)
+
+    tscale := w * 2 / 3 / tw
+    if tscale < 1 {
+        tscale = 1
+    }
+    x := (w - tw*tscale) / 2
+    y := (h - th*tscale) / 2
+    dst := image.Rect(x, y, x+tw*tscale, y+th*tscale)
+    draw.NearestNeighbor.Scale(canvas, dst, txt, txt.Bounds(), draw.Over, nil)
+    return canvas
+}
@@ -0,0 +1,65 @@
+package util
+
+import (
+    "fmt"
+    "os"
+    "path/filepath"
+    "regexp"
+    "strconv"
+    "strings"
+)
+
+/*
+ * A rar split into volumes is either named like name.part1.rar,
+ * name.part2.rar... or, the old way, name.rar, name.r00, name.r01...
+ * The first volume is opened like any other rar and rardecode follows
+ * the set from there, so the later volumes are never opened on their
+ * own.
+ *
+ * A file only counts as part of a set if the rest of the set is there,
+ * so a one off named issue.part2.cbr is still its own comic.
+ */
+var rarPartName = regexp.MustCompile(`(?i)^(.*\.part)(\d+)(\.(?:rar|cbr))$`)
+
+func rarPartPath(filePath string, m []string, n int) string {
+    return filepath.Join(filepath.Dir(filePath), fmt.Sprintf("%s%0*d%s", m[1], len(m[2]), n, m[3]))
+}
+
+func fileExists(filePath string) bool {
+    _, err := os.Stat(filePath)
+    return err == nil
+}
+
+// The first volume of the set filePath is a later volume of, ok is
+// false when it isn't a later volume
+func FirstRarVolume(filePath string) (string, bool) {
+    m := rarPartName.FindStringSubmatch(filepath.Base(filePath))
+    if m == nil {
+        return "", false
+    }
+    n, err := strconv.Atoi(m[2])
+    if err != nil || n <= 1 {
+        return "", false
+    }
+    first := rarPartPath(filePath, m, 1)
+    if !fileExists(first) {
+        return "", false
+    }
+    return first, true
+}
+
+// Whether filePath is the first volume of a set
+func rarVolumeSet(filePath string) bool {
+    m := rarPartName.FindStringSubmatch(filepath.Base(filePath))
+    if m != nil {
+        n, err := strconv.Atoi(m[2])
+        return err == nil && n == 1 && fileExists(rarPartPath(filePath, m, 2))
+    }
+    ext := filepath.Ext(filePath)
+    switch strings.ToLower(ext) {
+    case ".rar", ".cbr":
+        return fileExists(strings.TrimSuffix(filePath, ext)+".r00") ||
+            fileExists(strings.TrimSuffix(filePath, ext)+".R00")
+    }
+    return false
+}
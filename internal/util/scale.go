@@ -0,0 +1,96 @@
+package util
+
+import (
+    "fmt"
+    "image"
+    "math"
+
+    "golang.org/x/image/draw"
+)
+
+/*
+ * How pages are scaled to the window. Bilinear is quick and soft, hyper
+ * is gdk's best and slower, lanczos is a lanczos3 done in go, which is
+ * the sharpest way to shrink a big scan but too slow to do on the ui
+ * thread, so pages are drawn bilinear until it's done, see ScaleCache.
+ */
+type ScaleFilter int
+
+const (
+    FILTER_BILINEAR = iota
+    FILTER_HYPER
+    FILTER_LANCZOS
+)
+
+var scaleFilterNames = []string{"bilinear", "hyper", "lanczos"}
+
+func (f ScaleFilter) String() string {
+    if f < 0 || int(f) >= len(scaleFilterNames) {
+        return "unknown"
+    }
+    return scaleFilterNames[f]
+}
+
+// The one after f, round to the first again
+func (f ScaleFilter) Next() ScaleFilter {
+    return (f + 1) % ScaleFilter(len(scaleFilterNames))
+}
+
+// By name in settings.json
+func (f ScaleFilter) MarshalText() ([]byte, error) {
+    return []byte(f.String()), nil
+}
+
+func (f *ScaleFilter) UnmarshalText(b []byte) error {
+    for i, n := range scaleFilterNames {
+        if n == string(b) {
+            *f = ScaleFilter(i)
+            return nil
+        }
+    }
+    return fmt.Errorf("unknown scale filter %q", b)
+}
+
+var lanczos3 = &draw.Kernel{Support: 3, At: func(t float64) float64 {
+    if t == 0 {
+        return 1
+    }
+    x := math.Pi * t
+    return 3 * math.Sin(x) * math.Sin(x/3) / (x * x)
+}}
+
+// 8 bit rgb(a) pixels, like a pixbuf's, as a go image, shared when
+// they're already rgba
+func PixNRGBA(pix []byte, stride int, channels int, w int, h int) *image.NRGBA {
+    if channels == 4 {
+        return &image.NRGBA{Pix: pix, Stride: stride, Rect: image.Rect(0, 0, w, h)}
+    }
+    n := image.NewNRGBA(image.Rect(0, 0, w, h))
+    for y := 0; y < h; y++ {
+        s := pix[y*stride:]
+        d := n.Pix[y*n.Stride:]
+        for x := 0; x < w; x++ {
+            d[x*4], d[x*4+1], d[x*4+2], d[x*4+3] = s[x*3], s[x*3+1], s[x*3+2], 0xff
+        }
+    }
+    return n
+}
+
+// src scaled to w by h with lanczos3
+func ScaleLanczos(src *image.NRGBA, w int, h int) *image.NRGBA {
+    d := image.NewRGBA(image.Rect(0, 0, w, h))
+    lanczos3.Scale(d, d.Bounds(), src, src.Bounds(), draw.Src, nil)
+
+    // Scaling premultiplies, pixbufs don't, so take it back out
+    n := &image.NRGBA{Pix: d.Pix, Stride: d.Stride, Rect: d.Rect}
+    for i := 0; i+3 < len(n.Pix); i += 4 {
+        a := int(n.Pix[i+3])
+        if a == 0 || a == 0xff {
+            continue
+        }
+        for j := i; j < i+3; j++ {
+            n.Pix[j] = uint8(min(0xff, int(n.Pix[j])*0xff/a))
+        }
+    }
+    return n
+}
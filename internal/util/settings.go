@@ -0,0 +1,62 @@
+package util
+
+import (
+    "encoding/json"
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+)
+
+const SETTINGS_FN string = "settings.json"
+
+// User settings, read from settings.json in the config dir. Anything
+// the file leaves out keeps its default
+type Settings struct {
+    Limits    Limits      `json:"limits"`
+    Filter    ScaleFilter `json:"filter"`
+    CacheSize int64       `json:"cacheSize"`
+}
+
+// Bytes of decoded pages kept loaded, see the model's cache
+const DEFAULT_CACHE_SIZE = 512 << 20
+
+func DefaultSettings() Settings {
+    return Settings{
+        Limits:    DefaultLimits,
+        Filter:    FILTER_LANCZOS,
+        CacheSize: DEFAULT_CACHE_SIZE,
+    }
+}
+
+func settingsPath() (string, error) {
+    p, err := configPath()
+    if err != nil {
+        return p, err
+    }
+    return filepath.Join(p, SETTINGS_FN), nil
+}
+
+// Defaults and no error when there's no settings file, defaults and
+// an error when it can't be read
+func ReadSettings() (Settings, error) {
+    s := DefaultSettings()
+    fn, err := settingsPath()
+    if err != nil {
+        return s, err
+    }
+
+    b, err := os.ReadFile(fn)
+    if err != nil {
+        if errors.Is(err, fs.ErrNotExist) {
+            return s, nil
+        }
+        return s, err
+    }
+
+    err = json.Unmarshal(b, &s)
+    if err != nil {
+        return DefaultSettings(), err
+    }
+    return s, nil
+}
@@ -0,0 +1,729 @@
+package util
+
+import (
+    "archive/tar"
+    "archive/zip"
+    "bufio"
+    "bytes"
+    "errors"
+    "fmt"
+    "image"
+    "io"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "strings"
+    "sync"
+
+    "github.com/bodgit/sevenzip"
+    "github.com/nwaples/rardecode/v2"
+)
+
+/*
+ * A PageSource is an open cbx whose entries are read on demand
+ * by name, rather than extracting the whole thing up front.
+ *
+ * Entry names are slash separated paths relative to the root of
+ * the cbx, so they're stable from one open to the next and can be
+ * stored in layouts.
+ *
+ * Implementations must be safe to use from more than one goroutine.
+ */
+type PageSource interface {
+    // Names of all the regular files, in archive order
+    Entries() []string
+
+    // Stream the named entry
+    OpenEntry(name string) (io.ReadCloser, error)
+
+    // Read the whole of the named entry
+    ReadEntry(name string) ([]byte, error)
+
+    Close() error
+}
+
+var ErrEntryNotFound = errors.New("entry not found")
+
+// How to open a cbx, see OpenPageSource
+type OpenOptions struct {
+    // Where sources that keep copies of entries keep them
+    TmpDir string
+
+    // What the archive may contain
+    Limits Limits
+
+    // For encrypted archives, empty for none
+    Password string
+
+    // How zip entry names without the utf-8 flag are decoded
+    NameEncoding NameEncoding
+}
+
+// Opens the right kind of source for filePath, going by what the file
+// is rather than what it's named. Errors are an *OpenError naming that.
+// Sources that can't read entries cheaply more than once may keep 
+// copies of entries under opts.TmpDir, see CreateTmpDir. Archives that
+// go past opts.Limits aren't opened, and unsafe entries are left out.
+// Encrypted archives fail with ErrPasswordRequired without
+// opts.Password, and ErrBadPassword with the wrong one.
+func OpenPageSource(filePath string, opts OpenOptions) (PageSource, error) {
+    format, err := SniffFormat(filePath)
+    if err != nil {
+        return nil, err
+    }
+
+    var src PageSource
+    switch format {
+    case FORMAT_DIR:
+        src, err = openDirSource(filePath)
+    case FORMAT_ZIP:
+        src, err = openZipSource(filePath, opts)
+    case FORMAT_RAR:
+        src, err = openRarSource(filePath, opts.TmpDir, opts.Limits, opts.Password)
+    case FORMAT_7Z:
+        src, err = open7zSource(filePath, opts.Limits, opts.Password)
+    case FORMAT_TAR:
+        src, err = openTarSource(filePath, opts.Limits)
+    case FORMAT_PDF:
+        src, err = openPdfSource(filePath, opts.Limits)
+    case FORMAT_EPUB:
+        src, err = openEpubSource(filePath, opts.Limits)
+    default:
+        err = ErrUnknownFormat
+    }
+    if err != nil {
+        return nil, &OpenError{Path: filePath, Format: format, Err: err}
+    }
+    return src, nil
+}
+
+// Names of the entries that are pages, in archive order, see OrderPages.
+// Entries without an image extension are pages if they start like an
+// image, so misnamed ones aren't lost
+func PageEntries(src PageSource) []string {
+    var names []string
+    for _, n := range src.Entries() {
+        ext := strings.ToLower(filepath.Ext(n))
+        if validImageExt(ext) {
+            names = append(names, n)
+            continue
+        }
+        if notPageExt(ext) {
+            continue
+        }
+        if t, err := SniffEntry(src, n); err == nil && t != IMAGE_UNKNOWN {
+            names = append(names, n)
+        }
+    }
+    return names
+}
+
+// Whether any entry can be read without reading the ones before it,
+// so looking at every page while opening is quick, see ProbeEntry. Rar
+// and 7z may be solid and have to decompress everything up to it
+func RandomAccess(src PageSource) bool {
+    switch src.(type) {
+    case *zipSource, *epubSource, *tarSource, *dirSource:
+        return true
+    }
+    return false
+}
+
+// Check an entry can be read and looks like an image, without decoding
+// it. Width and height are 0 when go can't parse the format, the
+// entry might still be fine, only gdk can tell. Jpegs are measured the
+// way up their exif says, see decodeOrientedConfig
+func ProbeEntry(src PageSource, name string) (int, int, error) {
+    r, err := src.OpenEntry(name)
+    if err != nil {
+        return 0, 0, err
+    }
+    defer r.Close()
+
+    br := bufio.NewReader(r)
+    if _, err := br.Peek(1); err != nil {
+        if err == io.EOF {
+            return 0, 0, errors.New("empty entry")
+        }
+        return 0, 0, err
+    }
+    cfg, _, err := decodeOrientedConfig(br)
+    if err != nil {
+        if errors.Is(err, image.ErrFormat) {
+            return 0, 0, nil
+        }
+        return 0, 0, err
+    }
+    return cfg.Width, cfg.Height, nil
+}
+
+func readAllEntry(src PageSource, name string, max int64) ([]byte, error) {
+    r, err := src.OpenEntry(name)
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return readAllLimited(r, name, max)
+}
+
+func skipEntry(name string, err error) {
+    fmt.Printf("Warning skipping entry %s; %s\n", name, err)
+}
+
+// Zip has a central directory, so any entry can be read directly
+type zipSource struct {
+    r        *zip.ReadCloser
+    limits   Limits
+    password string
+    entries  []string
+    files    map[string]*zip.File
+}
+
+// Entries are known by their decoded names, see NameEncoding
+func openZipSource(filePath string, opts OpenOptions) (*zipSource, error) {
+    r, err := zip.OpenReader(filePath)
+    if err != nil {
+        return nil, err
+    }
+
+    enc := zipNameEncoding(r.File, opts.NameEncoding)
+    s := &zipSource{r: r, limits: opts.Limits, password: opts.Password, files: make(map[string]*zip.File)}
+    check := entryCheck{limits: opts.Limits}
+    var encrypted *zip.File
+    for _, f := range r.File {
+        // Decoded before anything else, a shift-jis trail byte can
+        // look like a backslash
+        name := f.Name
+        if f.NonUTF8 {
+            name = decodeName(name, enc)
+        }
+        if f.FileInfo().IsDir() {
+            continue
+        }
+        if f.Mode()&os.ModeSymlink != 0 {
+            skipEntry(name, fmt.Errorf("%w; symlink", ErrUnsafeEntry))
+            continue
+        }
+        if err := checkEntryName(name); err != nil {
+            skipEntry(name, err)
+            continue
+        }
+        err := check.add(name, int64(f.UncompressedSize64), int64(f.CompressedSize64))
+        if err != nil {
+            r.Close()
+            return nil, err
+        }
+        if _, ok := s.files[name]; !ok {
+            s.entries = append(s.entries, name)
+        }
+        s.files[name] = f
+        if zipEncrypted(f) && (encrypted == nil || f.CompressedSize64 < encrypted.CompressedSize64) {
+            encrypted = f
+        }
+    }
+
+    // The smallest entry is checked, see checkZipPassword
+    if encrypted != nil {
+        err := checkZipPassword(encrypted, opts.Password)
+        if err != nil {
+            r.Close()
+            return nil, err
+        }
+    }
+    return s, nil
+}
+
+func (s *zipSource) Entries() []string {
+    return s.entries
+}
+
+func (s *zipSource) OpenEntry(name string) (io.ReadCloser, error) {
+    f, ok := s.files[name]
+    if !ok {
+        return nil, fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+    }
+    if zipEncrypted(f) {
+        return openEncryptedZipEntry(f, s.password)
+    }
+    return f.Open()
+}
+
+func (s *zipSource) ReadEntry(name string) ([]byte, error) {
+    return readAllEntry(s, name, s.limits.MaxEntrySize)
+}
+
+func (s *zipSource) Close() error {
+    return s.r.Close()
+}
+
+/*
+ * 7z is read with a pure go reader, entries in a solid block are
+ * decompressed in sequence but the reader keeps its place, so reading
+ * pages in order doesn't start over each time
+ */
+type sevenZipSource struct {
+    mu      sync.Mutex
+    r       *sevenzip.ReadCloser
+    limits  Limits
+    entries []string
+    files   map[string]*sevenzip.File
+}
+
+// Solid blocks don't have a compressed size per file, so 7z
+// can only be held to the size limits
+func open7zSource(filePath string, limits Limits, password string) (*sevenZipSource, error) {
+    r, err := sevenzip.OpenReaderWithPassword(filePath, password)
+    if err != nil {
+        return nil, sevenZipError(err, password)
+    }
+
+    s := &sevenZipSource{r: r, limits: limits, files: make(map[string]*sevenzip.File)}
+    check := entryCheck{limits: limits}
+    for _, f := range r.File {
+        if f.FileInfo().IsDir() {
+            continue
+        }
+        if f.FileInfo().Mode()&os.ModeSymlink != 0 {
+            skipEntry(f.Name, fmt.Errorf("%w; symlink", ErrUnsafeEntry))
+            continue
+        }
+        if err := checkEntryName(f.Name); err != nil {
+            skipEntry(f.Name, err)
+            continue
+        }
+        err := check.add(f.Name, int64(f.UncompressedSize), 0)
+        if err != nil {
+            r.Close()
+            return nil, err
+        }
+        s.entries = append(s.entries, f.Name)
+        s.files[f.Name] = f
+    }
+
+    // Unless the headers are encrypted too, only reading an entry
+    // tells whether there's a password, or whether it's right
+    if len(s.entries) > 0 {
+        _, err := s.ReadEntry(s.entries[0])
+        var re *sevenzip.ReadError
+        if err != nil && errors.As(err, &re) && re.Encrypted {
+            r.Close()
+            return nil, sevenZipError(err, password)
+        }
+    }
+    return s, nil
+}
+
+func sevenZipError(err error, password string) error {
+    var re *sevenzip.ReadError
+    if !errors.As(err, &re) || !re.Encrypted {
+        return err
+    }
+    if password == "" {
+        return ErrPasswordRequired
+    }
+    return fmt.Errorf("%w; %s", ErrBadPassword, err)
+}
+
+func (s *sevenZipSource) Entries() []string {
+    return s.entries
+}
+
+func (s *sevenZipSource) ReadEntry(name string) ([]byte, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    f, ok := s.files[name]
+    if !ok {
+        return nil, fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+    }
+    r, err := f.Open()
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return readAllLimited(r, name, s.limits.MaxEntrySize)
+}
+
+func (s *sevenZipSource) OpenEntry(name string) (io.ReadCloser, error) {
+    b, err := s.ReadEntry(name)
+    if err != nil {
+        return nil, err
+    }
+    return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *sevenZipSource) Close() error {
+    return s.r.Close()
+}
+
+/*
+ * Tar has no index, but it isn't compressed either, so the headers are
+ * read once and after that entries are read directly by offset
+ */
+type tarSource struct {
+    f       *os.File
+    entries []string
+    offsets map[string]int64
+    sizes   map[string]int64
+}
+
+// Tar isn't compressed, so only the size limits apply, and entries
+// can't be bigger than they say
+func openTarSource(filePath string, limits Limits) (*tarSource, error) {
+    f, err := os.Open(filePath)
+    if err != nil {
+        return nil, err
+    }
+
+    s := &tarSource{f: f, offsets: make(map[string]int64), sizes: make(map[string]int64)}
+    check := entryCheck{limits: limits}
+    tr := tar.NewReader(f)
+    for {
+        hdr, err := tr.Next()
+        if err != nil {
+            if err == io.EOF {
+                break
+            }
+            f.Close()
+            return nil, err
+        }
+        if hdr.Typeflag == tar.TypeSymlink || hdr.Typeflag == tar.TypeLink {
+            skipEntry(hdr.Name, fmt.Errorf("%w; link", ErrUnsafeEntry))
+            continue
+        }
+        if hdr.Typeflag != tar.TypeReg {
+            continue
+        }
+        if err := checkEntryName(hdr.Name); err != nil {
+            skipEntry(hdr.Name, err)
+            continue
+        }
+        if err := check.add(hdr.Name, hdr.Size, 0); err != nil {
+            f.Close()
+            return nil, err
+        }
+
+        // The tar reader reads headers straight from f, so after Next
+        // f is positioned at the start of the entry's data
+        off, err := f.Seek(0, io.SeekCurrent)
+        if err != nil {
+            f.Close()
+            return nil, err
+        }
+
+        name := strings.TrimPrefix(hdr.Name, "./")
+        if _, ok := s.offsets[name]; !ok {
+            s.entries = append(s.entries, name)
+        }
+        s.offsets[name] = off
+        s.sizes[name] = hdr.Size
+    }
+    return s, nil
+}
+
+func (s *tarSource) Entries() []string {
+    return s.entries
+}
+
+func (s *tarSource) OpenEntry(name string) (io.ReadCloser, error) {
+    off, ok := s.offsets[name]
+    if !ok {
+        return nil, fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+    }
+    return io.NopCloser(io.NewSectionReader(s.f, off, s.sizes[name])), nil
+}
+
+func (s *tarSource) ReadEntry(name string) ([]byte, error) {
+    return readAllEntry(s, name, 0)
+}
+
+func (s *tarSource) Close() error {
+    return s.f.Close()
+}
+
+/*
+ * Rar, 4 or 5 and single files or volume sets, see FirstRarVolume, is
+ * read with rardecode. Entries of a plain rar are read directly,
+ * but an entry of a solid one can only be decompressed after everything
+ * before it, so those are read in order and each is kept under tmpDir
+ * as it goes by, that way paging back and forth doesn't get slower as
+ * you go.
+ */
+type rarSource struct {
+    mu       sync.Mutex
+    filePath string
+    password string
+    spillDir string
+    limits   Limits
+    entries  []string
+    files    map[string]*rardecode.File
+    seq      *rardecode.ReadCloser
+}
+
+func openRarSource(filePath string, tmpDir string, limits Limits, password string) (*rarSource, error) {
+    files, err := rardecode.List(filePath, rarOptions(password)...)
+    if err != nil {
+        return nil, rarError(err, password)
+    }
+
+    // Entries are kept in a dir of their own so they can't clash
+    // with anything else in tmpDir
+    spillDir := filepath.Join(tmpDir, TMP_ENTRIES_DN)
+    s := &rarSource{filePath: filePath, password: password, spillDir: spillDir,
+        limits: limits, files: make(map[string]*rardecode.File)}
+    check := entryCheck{limits: limits}
+    spans := rarVolumeSet(filePath)
+    var encrypted string
+    for _, f := range files {
+        if f.IsDir {
+            continue
+        }
+        if f.Mode()&os.ModeSymlink != 0 || f.LinkType != 0 {
+            skipEntry(f.Name, fmt.Errorf("%w; link", ErrUnsafeEntry))
+            continue
+        }
+        if err := checkEntryName(f.Name); err != nil {
+            skipEntry(f.Name, err)
+            continue
+        }
+        // The packed size of an entry that goes on into the next
+        // volume is only the part in this one, so it's no measure of
+        // how well it compresses
+        packed := f.PackedSize
+        if spans {
+            packed = 0
+        }
+        if err := check.add(f.Name, f.UnPackedSize, packed); err != nil {
+            return nil, err
+        }
+        if _, ok := s.files[f.Name]; !ok {
+            s.entries = append(s.entries, f.Name)
+        }
+        s.files[f.Name] = f
+        if f.Encrypted && encrypted == "" {
+            encrypted = f.Name
+        }
+    }
+
+    // Older rars have no password check, a wrong password just decrypts
+    // to garbage, so an entry is read to find out
+    if encrypted != "" {
+        if password == "" {
+            return nil, ErrPasswordRequired
+        }
+        if _, err := s.ReadEntry(encrypted); err != nil {
+            s.Close()
+            if errors.Is(err, ErrLimitExceeded) {
+                return nil, err
+            }
+            return nil, fmt.Errorf("%w; %s", ErrBadPassword, err)
+        }
+    }
+    return s, nil
+}
+
+func rarOptions(password string) []rardecode.Option {
+    if password == "" {
+        return nil
+    }
+    return []rardecode.Option{rardecode.Password(password)}
+}
+
+// Rars with encrypted headers can't even be listed without the
+// password, and older ones fail the header checks with a wrong one
+func rarError(err error, password string) error {
+    switch {
+    case errors.Is(err, rardecode.ErrArchiveEncrypted),
+        errors.Is(err, rardecode.ErrArchivedFileEncrypted):
+        return ErrPasswordRequired
+    case errors.Is(err, rardecode.ErrBadPassword):
+        return ErrBadPassword
+    case password != "" && errors.Is(err, rardecode.ErrBadHeaderCRC):
+        return fmt.Errorf("%w; %s", ErrBadPassword, err)
+    }
+    return err
+}
+
+func (s *rarSource) Entries() []string {
+    return s.entries
+}
+
+// Names were checked when the archive was opened, this is just
+// making sure
+func (s *rarSource) spillPath(name string) (string, error) {
+    sp := filepath.Join(s.spillDir, filepath.FromSlash(name))
+    rel, err := filepath.Rel(s.spillDir, sp)
+    if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+        return "", fmt.Errorf("%w; %s", ErrUnsafeEntry, name)
+    }
+    return sp, nil
+}
+
+// Failing to keep a copy only costs time later
+func (s *rarSource) spill(name string, b []byte) {
+    sp, err := s.spillPath(name)
+    if err != nil {
+        return
+    }
+    if err := os.MkdirAll(filepath.Dir(sp), 0700); err == nil {
+        os.WriteFile(sp, b, 0600)
+    }
+}
+
+func (s *rarSource) spilled(name string) bool {
+    sp, err := s.spillPath(name)
+    if err != nil {
+        return false
+    }
+    _, err = os.Stat(sp)
+    return err == nil
+}
+
+func (s *rarSource) ReadEntry(name string) ([]byte, error) {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+
+    f, ok := s.files[name]
+    if !ok {
+        return nil, fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+    }
+
+    sp, err := s.spillPath(name)
+    if err != nil {
+        return nil, err
+    }
+    if b, err := os.ReadFile(sp); err == nil {
+        return b, nil
+    }
+
+    max := s.limits.MaxEntrySize
+    if max > 0 && f.UnPackedSize > max {
+        return nil, fmt.Errorf("%w; %s is more than %s (maxEntrySize)",
+            ErrLimitExceeded, name, byteSize(max))
+    }
+    if f.Solid {
+        return s.readSolid(name)
+    }
+
+    r, err := f.Open()
+    if err != nil {
+        return nil, err
+    }
+    defer r.Close()
+    return readAllLimited(r, name, max)
+}
+
+// Carries on from wherever the last solid read left off, starting over
+// once if name has already gone by
+func (s *rarSource) readSolid(name string) ([]byte, error) {
+    opened := false
+    for {
+        if s.seq == nil {
+            rc, err := rardecode.OpenReader(s.filePath, rarOptions(s.password)...)
+            if err != nil {
+                return nil, err
+            }
+            s.seq = rc
+            opened = true
+        }
+
+        h, err := s.seq.Next()
+        if err != nil {
+            s.closeSeq()
+            if err == io.EOF {
+                if !opened {
+                    continue
+                }
+                err = fmt.Errorf("%s: %w", name, ErrEntryNotFound)
+            }
+            return nil, err
+        }
+        if _, ok := s.files[h.Name]; !ok || h.IsDir {
+            continue
+        }
+        if h.Name != name && s.spilled(h.Name) {
+            continue
+        }
+
+        b, err := readAllLimited(s.seq, h.Name, s.limits.MaxEntrySize)
+        if err != nil {
+            s.closeSeq()
+            return nil, err
+        }
+        s.spill(h.Name, b)
+        if h.Name == name {
+            return b, nil
+        }
+    }
+}
+
+func (s *rarSource) closeSeq() {
+    if s.seq != nil {
+        s.seq.Close()
+        s.seq = nil
+    }
+}
+
+func (s *rarSource) OpenEntry(name string) (io.ReadCloser, error) {
+    b, err := s.ReadEntry(name)
+    if err != nil {
+        return nil, err
+    }
+    return io.NopCloser(bytes.NewReader(b)), nil
+}
+
+func (s *rarSource) Close() error {
+    s.mu.Lock()
+    defer s.mu.Unlock()
+    s.closeSeq()
+    return nil
+}
+
+// A directory of images is read in place. Only the entries it was
+// opened with can be read, not whatever a name joined onto dir finds
+type dirSource struct {
+    dir     string
+    entries []string
+    names   map[string]bool
+}
+
+func openDirSource(dirPath string) (*dirSource, error) {
+    paths, err := listDir(dirPath)
+    if err != nil {
+        return nil, err
+    }
+
+    s := &dirSource{dir: dirPath, names: make(map[string]bool)}
+    for _, p := range paths {
+        rel, err := filepath.Rel(dirPath, p)
+        if err != nil {
+            return nil, err
+        }
+        name := filepath.ToSlash(rel)
+        s.entries = append(s.entries, name)
+        s.names[name] = true
+    }
+    return s, nil
+}
+
+func (s *dirSource) Entries() []string {
+    return s.entries
+}
+
+func (s *dirSource) OpenEntry(name string) (io.ReadCloser, error) {
+    if !s.names[name] {
+        return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+    }
+    return os.Open(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+func (s *dirSource) ReadEntry(name string) ([]byte, error) {
+    if !s.names[name] {
+        return nil, fmt.Errorf("%s: %w", name, fs.ErrNotExist)
+    }
+    return os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+}
+
+func (s *dirSource) Close() error {
+    return nil
+}
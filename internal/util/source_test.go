@@ -0,0 +1,52 @@
+package util
+
+import (
+    "errors"
+    "io/fs"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// A directory source reads the pages it found and nothing else, not
+// what a name like ../x joined onto the directory happens to find
+func TestDirSourceEntries(t *testing.T) {
+    root := t.TempDir()
+    dir := filepath.Join(root, "issue1")
+    for _, p := range []string{"issue1/p01.jpg", "issue1/sub/p02.jpg", "issue1/.hidden.jpg", "secret.txt"} {
+        p = filepath.Join(root, filepath.FromSlash(p))
+        if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+            t.Fatal(err)
+        }
+        if err := os.WriteFile(p, []byte(p), 0o644); err != nil {
+            t.Fatal(err)
+        }
+    }
+
+    src, err := openDirSource(dir)
+    if err != nil {
+        t.Fatal(err)
+    }
+    defer src.Close()
+
+    for _, name := range []string{"p01.jpg", "sub/p02.jpg"} {
+        if _, err := src.ReadEntry(name); err != nil {
+            t.Fatalf("read %s: %v", name, err)
+        }
+        r, err := src.OpenEntry(name)
+        if err != nil {
+            t.Fatalf("open %s: %v", name, err)
+        }
+        r.Close()
+    }
+
+    for _, name := range []string{"../secret.txt", "sub/../../secret.txt", ".hidden.jpg",
+        filepath.ToSlash(filepath.Join(root, "secret.txt")), "missing.jpg", "sub"} {
+        if _, err := src.ReadEntry(name); !errors.Is(err, fs.ErrNotExist) {
+            t.Fatalf("read %s: got %v, want %v", name, err, fs.ErrNotExist)
+        }
+        if _, err := src.OpenEntry(name); !errors.Is(err, fs.ErrNotExist) {
+            t.Fatalf("open %s: got %v, want %v", name, err, fs.ErrNotExist)
+        }
+    }
+}
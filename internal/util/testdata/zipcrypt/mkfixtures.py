@@ -0,0 +1,118 @@
+#!/usr/bin/env python3
+#
+# Makes the encrypted zips zipcrypt_test.go reads. Zipcrypto.zip is made
+# by info-zip's zip, which always puts the crc after the data, so the
+# password check is on the time. Zipcrypto-crc.zip, checked on the crc,
+# and the aes ones are written here, to pkware's appnote and winzip's
+# AE-1/AE-2 spec, with openssl doing the aes, so none of them go through
+# the code they're testing. Run it from this directory.
+#
+#   https://pkwaredownloads.blob.core.windows.net/pem/APPNOTE.txt
+#   https://www.winzip.com/en/support/aes-encryption/
+
+import hashlib
+import hmac
+import os
+import struct
+import subprocess
+import zlib
+
+PASSWORD = "cbxv-secret"
+NAME = "page.txt"
+DATA = b"".join(b"line %02d of a page that spans a few aes blocks\n" % i for i in range(40))
+
+
+def zipcrypto():
+    with open(NAME, "wb") as f:
+        f.write(DATA)
+    if os.path.exists("zipcrypto.zip"):
+        os.remove("zipcrypto.zip")
+    subprocess.run(["zip", "-q", "-X", "-P", PASSWORD, "zipcrypto.zip", NAME], check=True)
+    os.remove(NAME)
+
+
+def crc32_update(crc, b):
+    return zlib.crc32(bytes([b]), crc ^ 0xffffffff) ^ 0xffffffff
+
+
+def zipcrypto_encrypt(data):
+    keys = [0x12345678, 0x23456789, 0x34567890]
+
+    def update(b):
+        keys[0] = crc32_update(keys[0], b)
+        keys[1] = ((keys[1] + (keys[0] & 0xff)) * 134775813 + 1) & 0xffffffff
+        keys[2] = crc32_update(keys[2], keys[1] >> 24)
+
+    for b in PASSWORD.encode():
+        update(b)
+    out = bytearray()
+    for b in data:
+        t = (keys[2] | 2) & 0xffff
+        out.append(b ^ (((t * (t ^ 1)) >> 8) & 0xff))
+        update(b)
+    return bytes(out)
+
+
+def zipcrypto_crc(fn):
+    c = zlib.compressobj(9, zlib.DEFLATED, -15)
+    body = c.compress(DATA) + c.flush()
+    crc = zlib.crc32(DATA)
+    payload = zipcrypto_encrypt(os.urandom(11) + bytes([crc >> 24]) + body)
+    write_zip(fn, 20, 1, 8, crc, payload, b"")
+
+
+def aes_ctr(key, data):
+    # Winzip's counter is little endian and starts at 1, openssl's ctr
+    # mode is big endian, so the key stream is made block by block
+    blocks = (len(data) + 15) // 16
+    ctrs = b"".join((i + 1).to_bytes(16, "little") for i in range(blocks))
+    bits = len(key) * 8
+    stream = subprocess.run(["openssl", "enc", "-aes-%d-ecb" % bits, "-nopad", "-K", key.hex()],
+                            input=ctrs, stdout=subprocess.PIPE, check=True).stdout
+    return bytes(a ^ b for a, b in zip(data, stream))
+
+
+def aes_zip(fn, strength, version, method, tamper=False):
+    key_len = 8 + 8 * strength
+    salt = os.urandom(key_len // 2)
+    keys = hashlib.pbkdf2_hmac("sha1", PASSWORD.encode(), salt, 1000, 2 * key_len + 2)
+    enc_key, mac_key, verifier = keys[:key_len], keys[key_len:2 * key_len], keys[2 * key_len:]
+
+    body = DATA
+    if method == 8:
+        c = zlib.compressobj(9, zlib.DEFLATED, -15)
+        body = c.compress(DATA) + c.flush()
+    body = aes_ctr(enc_key, body)
+    mac = hmac.new(mac_key, body, hashlib.sha1).digest()[:10]
+    if tamper:
+        mac = mac[:-1] + bytes([mac[-1] ^ 0xff])
+    payload = salt + verifier + body + mac
+
+    crc = zlib.crc32(DATA) if version == 1 else 0
+    extra = struct.pack("<HHH2sBH", 0x9901, 7, version, b"AE", strength, method)
+    write_zip(fn, 51, 1, 99, crc, payload, extra)
+
+
+# A zip of one entry, NAME, that's payload once it's been decrypted
+def write_zip(fn, version, flags, method, crc, payload, extra):
+    name = NAME.encode()
+    dos_time, dos_date = 0, (2024 - 1980) << 9 | 1 << 5 | 1
+    local = struct.pack("<IHHHHHIIIHH", 0x04034b50, version, flags, method, dos_time, dos_date,
+                        crc, len(payload), len(DATA), len(name), len(extra)) + name + extra
+    central = struct.pack("<IHHHHHHIIIHHHHHII", 0x02014b50, version, version, flags, method,
+                          dos_time, dos_date, crc, len(payload), len(DATA), len(name), len(extra),
+                          0, 0, 0, 0, 0) + name + extra
+    end = struct.pack("<IHHHHIIH", 0x06054b50, 0, 0, 1, 1, len(central), len(local) + len(payload), 0)
+    with open(fn, "wb") as f:
+        f.write(local + payload + central + end)
+
+
+zipcrypto()
+zipcrypto_crc("zipcrypto-crc.zip")
+aes_zip("aes128-ae1.zip", 1, 1, 0)
+aes_zip("aes128-ae2.zip", 1, 2, 8)
+aes_zip("aes256-ae1.zip", 3, 1, 8)
+aes_zip("aes256-ae2.zip", 3, 2, 0)
+aes_zip("aes256-badmac.zip", 3, 2, 8, tamper=True)
+with open("page.txt.golden", "wb") as f:
+    f.write(DATA)
@@ -1,7 +1,6 @@
 package util
 
 import (
-	"archive/zip"
 	"crypto/md5"
 	"embed"
     "errors"
@@ -9,17 +8,14 @@ import (
 	"io"
 	"io/fs"
 	"io/ioutil"
-	"math/rand"
 	"net/url"
 	"os"
 	"path/filepath"
 	"runtime"
-	"sort"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
-
-	"github.com/gen2brain/go-unarr"
-	"github.com/pdfcpu/pdfcpu/pkg/api"
 )
 
 const RENDERERSTATE_FN string = "rendererstate.json"
@@ -27,6 +23,12 @@ const CBXS_DN string = "cbxv"
 const BOOKMARKS_DN string = "bookmarks"
 const LAYOUTS_DN string = "layouts"
 const TMP_CBXS_PREFIX string = "cbxv-"
+const TMP_PID_FN string = "cbxv.pid"
+const TMP_ENTRIES_DN string = "entries"
+
+// Tmp dirs without a pid marker are from older versions, or are being
+// set up right now, they're only removed once they're this old
+const TMP_UNMARKED_AGE = 24 * time.Hour
 const DEBUG = false
 
 const HELP_TXT = `<tt>
@@ -49,9 +51,27 @@ toggleDirection     [BackTick]          Direction Toggle
 stripLayout         3                   NA
 hidePage            -                   NA
 toggleJoin          r                   Join Toggle
+rotatePageLeft      [                   NA
+rotatePageRight     ]                   NA
+toggleCrop          x                   NA
+editCrop            X                   NA
+toggleMatchHeights  m                   NA
+toggleTrimGutter    g                   NA
+Fit Window          4                   NA
+Fit Width           5                   NA
+Fit Height          6                   NA
+Original Size       7                   NA
+toggleNoUpscale     u                   NA
+cycleScaleFilter    i                   NA
+panUp|Down          W|S|[PgUp]|[PgDn]   Drag or Wheel
+panLeft|Right       A|D                 Drag or Wheel
+zoomIn|Out          +|=|_               Ctrl+Wheel or Pinch
+zoomReset           0                   NA
+Loupe               NA                  Hold Right Button
 toggleFullscreen    f|[F11]             Fullscreen Toggle
 selectPage          [Tab]               Page Index Buttons
 exportPage          e                   Export Page Button
+setNameEncoding     N                   NA
 
 <a href="https://mftb0.github.io/cbxv">Program Manual</a>
 
@@ -205,27 +225,41 @@ func RestoreIcon() string {
     return r
 }
 
-func createRandomString(n int) string {
-    var letter = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789")
-    rand.Seed(time.Now().UnixNano())
-    b := make([]rune, n)
-    for i := range b {
-        b[i] = letter[rand.Intn(len(letter))]
-    }
-    return string(b)
-}
-
 func validCBXExt(ext string) bool {
      if ext != ".cbz" &&
         ext != ".cbr" &&
+        ext != ".rar" &&
         ext != ".cb7" &&
         ext != ".cbt" &&
-        ext != ".pdf" {
+        ext != ".pdf" &&
+        ext != ".epub" {
         return false
     }
     return true
 }
 
+// Files that come with comics but are never pages, so they're
+// not worth sniffing, see PageEntries
+func notPageExt(ext string) bool {
+    switch ext {
+    case ".xml", ".txt", ".nfo", ".sfv", ".md5", ".db", ".ini", ".url",
+        ".htm", ".html", ".xhtml", ".css", ".opf", ".ncx", ".json", ".pdf",
+        ".zip", ".rar", ".7z", ".cbz", ".cbr", ".cb7", ".cbt", ".epub":
+        return true
+    }
+    return false
+}
+
+// What validImageExt was before layout 0.3, entries with anything else
+// weren't pages then, see LegacyPageOrder
+func legacyImageExt(ext string) bool {
+    switch ext {
+    case ".jpg", ".jpeg", ".png", ".webp", ".avif", ".heic", ".gif":
+        return true
+    }
+    return false
+}
+
 func validImageExt(ext string) bool {
     if ext != ".jpg" &&
         ext != ".jpeg" &&
@@ -233,184 +267,49 @@ func validImageExt(ext string) bool {
         ext != ".webp" &&
         ext != ".avif" &&
         ext != ".heic" &&
+        ext != ".jxl" &&
+        ext != ".bmp" &&
+        ext != ".tif" &&
+        ext != ".tiff" &&
         ext != ".gif" {
         return false
     }
     return true
 }
 
-func extractZipWorker(dst *os.File, src io.ReadCloser, errors chan error) {
-    _, err := io.Copy(dst, src)
-    dst.Close()
-    src.Close()
-    if err != nil {
-        errors <- err
-    } else {
-        errors <- nil
-    }
-}
-
-func extractZip(filePath string, tmpDir string) ([]string, error) {
-
-    r, err := zip.OpenReader(filePath)
-    if err != nil {
-        return nil, err
-    }
-    defer r.Close()
-
-    var urls []string
-    workerMax := runtime.NumCPU()
-    workerCount := 0
-    workerErrors := make(chan error, workerMax)
-    for _, f := range r.File {
-        fp := filepath.Join(tmpDir, f.Name)
-
-        // If entry is a dir create and we're done
-        if f.FileInfo().IsDir() {
-            os.MkdirAll(fp, os.ModePerm)
-            continue
-        }
-
-        // If extension isn't a useful one we're done
-        ext := strings.ToLower(filepath.Ext(fp))
-        if !validImageExt(ext) {
-            continue
-        }
-
-        url := fp
-        urls = append(urls, url)
-
-        if err = os.MkdirAll(filepath.Dir(fp), os.ModePerm); err != nil {
-            return nil, err
-        }
-
-        // Closed in extractZipWorker
-        dst, err := os.OpenFile(fp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, f.Mode())
-        if err != nil {
-            return nil, err
-        }
-
-        // Closed in extractZipWorker
-        entry, err := f.Open()
+// Every regular file in a directory at any depth, in no particular
+// order. Dot files are skipped, they're usually resource forks and 
+// thumbnails
+func listDir(dirPath string) ([]string, error) {
+    var paths []string
+    err := filepath.WalkDir(dirPath, func(p string, d fs.DirEntry, err error) error {
         if err != nil {
-            return nil, err
+            return err
         }
-
-        // Create workers up to num cpus
-        if workerCount < workerMax {
-            workerCount++
-
-            // A worker extracts a file from the zip and
-            // writes errs to errs channel
-            go extractZipWorker(dst, entry, workerErrors)
-        } else {
-
-            // Loop blocking for workers to report
-            // We bail on the first err
-            for i := 0; i < workerMax; i++ {
-                err := <-workerErrors
-                workerCount--
-                if err != nil {
-                    return nil, err
-                }
+        if p != dirPath && strings.HasPrefix(d.Name(), ".") {
+            if d.IsDir() {
+                return fs.SkipDir
             }
-
-            // Now that we've cleaned up, handle this zip entry
-            workerCount++
-            go extractZipWorker(dst, entry, workerErrors)
+            return nil
         }
-    }
-
-    // Wait for stragglers
-    for i := workerCount; i > 0; i-- {
-        err := <-workerErrors
-        if err != nil {
-            return nil, err
+        if !d.Type().IsRegular() {
+            return nil
         }
-    }
-
-    sort.Strings(urls)
-    return urls, nil
-}
-
-func extractPdf(filePath string, tmpDir string) ([]string, error) {
-    err := os.MkdirAll(tmpDir, os.ModePerm)
-    if err != nil {
-        return nil, err 
-    }
-
-    err = api.ExtractImagesFile(filePath, tmpDir, nil, nil)
-    if err != nil {
-        return nil, err 
-    }
-
-    urls := make([]string, 0)
-    entries, err := os.ReadDir(tmpDir)
+        paths = append(paths, p)
+        return nil
+    })
     if err != nil {
         return nil, err
     }
-
-    for _, entry := range entries {
-        ext := strings.ToLower(filepath.Ext(entry.Name()))
-        if !validImageExt(ext) {
-            continue
-        }
-        entryPath := filepath.Join(tmpDir, entry.Name())
-        urls = append(urls, entryPath)
-    }
-
-    sort.Strings(urls)
-    return urls, nil
+    return paths, nil
 }
 
-func extractRar(filePath string, tmpDir string) ([]string, error) {
-    a, err := unarr.NewArchive(filePath)
+func IsDir(filePath string) bool {
+    info, err := os.Stat(filePath)
     if err != nil {
-        return nil, err
-    }
-    defer a.Close()
-    entries, err := a.Extract(tmpDir)
-    if err != nil {
-        return nil, err
-    }
-
-    var urls []string
-    for _, entry := range entries {
-        ext := strings.ToLower(filepath.Ext(entry))
-        if !validImageExt(ext) {
-            continue
-        }
-
-        fp := filepath.Join(tmpDir, entry)
-        url := fp
-        urls = append(urls, url)
-    }
-
-    sort.Strings(urls)
-    return urls, nil
-}
-
-func extract(filePath string, tmpDir string) ([]string, error) {
-
-    ext := filepath.Ext(filePath)
-    if ext == ".pdf" {
-        result, err := extractPdf(filePath, tmpDir)
-        if err != nil {
-            return nil, err
-        } else {
-           return result, nil
-        }
-    }
-
-    result, err := extractZip(filePath, tmpDir)
-    if err != nil {
-        rr, err := extractRar(filePath, tmpDir)
-        if err != nil {
-            return nil, err
-        }
-        result = rr
+        return false
     }
-    return result, nil
+    return info.IsDir()
 }
 
 func isDirLink(entry os.DirEntry, filepath string) bool {
@@ -442,22 +341,79 @@ func rmCBXTmpDir(dirname string) error {
     return os.RemoveAll(tmpDir)
 }
 
+// Only readable by the user, pages of whatever they're reading
+// are kept in it. It's marked with our pid, so if we die without
+// removing it the next cbxv to start can, see RemoveOrphanedTmpDirs
 func CreateTmpDir() (string, error) {
-    rs := createRandomString(6)
-    tp := filepath.Join(tmpPath(), fmt.Sprintf("%s%s", TMP_CBXS_PREFIX, rs))
-    return tp, nil
+    td, err := os.MkdirTemp(tmpPath(), TMP_CBXS_PREFIX+"*")
+    if err != nil {
+        return "", err
+    }
+
+    pid := strconv.Itoa(os.Getpid())
+    err = os.WriteFile(filepath.Join(td, TMP_PID_FN), []byte(pid), 0600)
+    if err != nil {
+        os.RemoveAll(td)
+        return "", err
+    }
+    return td, nil
 }
 
-func GetImagePaths(filePath string, tmpDir string) ([]string, error) {
-    return extract(filePath, tmpDir)
+// Remove the tmp dirs left behind by cbxvs that crashed or were killed
+func RemoveOrphanedTmpDirs() {
+    dirs, err := filepath.Glob(filepath.Join(tmpPath(), TMP_CBXS_PREFIX+"*"))
+    if err != nil {
+        return
+    }
+    for _, d := range dirs {
+        if !tmpDirOrphaned(d) {
+            continue
+        }
+        err := rmCBXTmpDir(filepath.Base(d))
+        if err != nil && !errors.Is(err, fs.ErrPermission) {
+            fmt.Printf("Warning unable to remove orphaned tmp dir %s\n", err)
+        }
+    }
+}
+
+func tmpDirOrphaned(dir string) bool {
+    // Lstat, a link named like a tmp dir isn't ours to follow
+    info, err := os.Lstat(dir)
+    if err != nil || !info.IsDir() {
+        return false
+    }
+
+    b, err := os.ReadFile(filepath.Join(dir, TMP_PID_FN))
+    if err != nil {
+        return time.Since(info.ModTime()) > TMP_UNMARKED_AGE
+    }
+    pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+    if err != nil {
+        return true
+    }
+    return !processAlive(pid)
+}
+
+// On windows finding the process is enough, elsewhere FindProcess
+// always succeeds, so it's sent the null signal to see if it's there
+func processAlive(pid int) bool {
+    p, err := os.FindProcess(pid)
+    if err != nil {
+        return false
+    }
+    if runtime.GOOS == "windows" {
+        return true
+    }
+    err = p.Signal(syscall.Signal(0))
+    return err == nil || errors.Is(err, fs.ErrPermission)
 }
 
-func ExportPage(srcPath string, dstPath string) error {
-    src, err := os.Open(srcPath)
+func ExportPage(src PageSource, name string, dstPath string) error {
+    r, err := src.OpenEntry(name)
     if err != nil {
         return err
     }
-    defer src.Close()
+    defer r.Close()
 
     dst, err := os.Create(dstPath)
     if err != nil {
@@ -465,13 +421,15 @@ func ExportPage(srcPath string, dstPath string) error {
     }
     defer dst.Close()
 
-    _, err = io.Copy(dst, src)
+    _, err = io.Copy(dst, r)
     if err != nil {
         return err
     }
     return nil
 }
 
+// The md5 of the whole file, what layouts and bookmarks were keyed
+// by before fingerprints, see Fingerprint
 func HashFile(filePath string) (string, error) {
     f, err := os.Open(filePath)
     if err != nil {
@@ -488,18 +446,42 @@ func HashFile(filePath string) (string, error) {
     return hash, nil
 }
 
+// Directories don't have contents to hash, the fingerprint is made
+// from the name and size of each image in them instead, so it's stable
+// as long as the images are
+func HashDir(dirPath string) (string, error) {
+    paths, err := listDir(dirPath)
+    if err != nil {
+        return "", err
+    }
+    SortNatural(paths)
+
+    h := md5.New()
+    for _, u := range paths {
+        if !validImageExt(strings.ToLower(filepath.Ext(u))) {
+            continue
+        }
+        info, err := os.Stat(u)
+        if err != nil {
+            return "", err
+        }
+        rel, err := filepath.Rel(dirPath, u)
+        if err != nil {
+            return "", err
+        }
+        fmt.Fprintf(h, "%s\x00%d\x00", filepath.ToSlash(rel), info.Size())
+    }
+
+    hash := fmt.Sprintf("%x", h.Sum(nil))
+    return hash, nil
+}
+
 func WriteBookmarkList(hash string, data string) error {
     bPath, err := bookmarksPath()
     if err != nil {
         return err
     }
-    if err := os.MkdirAll(bPath, 0777); err != nil {
-        return err
-    }
-
-    storePath := filepath.Join(bPath, fmt.Sprintf("%s.json", hash))
-    os.WriteFile(storePath, []byte(data), 0777)
-    return nil
+    return writeStateFile(bPath, fmt.Sprintf("%s.json", hash), data)
 }
 
 func ReadBookmarkList(hash string) (*string, error) {
@@ -524,13 +506,7 @@ func WriteLayout(hash string, data string) error {
     if err != nil {
         return err
     }
-    if err := os.MkdirAll(lPath, 0777); err != nil {
-        return err
-    }
-
-    storePath := filepath.Join(lPath, fmt.Sprintf("%s.json", hash))
-    os.WriteFile(storePath, []byte(data), 0777)
-    return nil
+    return writeStateFile(lPath, fmt.Sprintf("%s.json", hash), data)
 }
 
 func ReadLayout(hash string) (*string, error) {
@@ -556,16 +532,22 @@ func WriteRendererState(data string) error {
         return err
     }
 
-    if err := os.MkdirAll(cPath, os.ModeDir); err != nil {
+    return writeStateFile(cPath, RENDERERSTATE_FN, data)
+}
+
+// State says what someone reads, so it's only readable by them. Files
+// written by older versions are fixed up as they're rewritten
+func writeStateFile(dir string, name string, data string) error {
+    if err := os.MkdirAll(dir, 0700); err != nil {
         return err
     }
+    os.Chmod(dir, 0700)
 
-    storePath, err := rendererstatePath()
-    if err != nil {
+    storePath := filepath.Join(dir, name)
+    if err := os.WriteFile(storePath, []byte(data), 0600); err != nil {
         return err
     }
-
-    return os.WriteFile(storePath, []byte(data), 0666)
+    return os.Chmod(storePath, 0600)
 }
 
 func ReadRendererState() (string, error) {
@@ -581,6 +563,24 @@ func ReadRendererState() (string, error) {
     return fmt.Sprintf("%s", s), nil
 }
 
+// Test if a directory has any images in it, at any depth
+func hasImages(dirPath string) bool {
+    found := false
+    filepath.WalkDir(dirPath, func(p string, d fs.DirEntry, err error) error {
+        if err != nil {
+            return nil
+        }
+        if !d.IsDir() && validImageExt(strings.ToLower(filepath.Ext(p))) {
+            found = true
+            return fs.SkipAll
+        }
+        return nil
+    })
+    return found
+}
+
+// The series of a cbx file is the cbx files next to it, the series
+// of a directory of images is the directories of images next to it
 func ReadSeriesList(filePath string) ([]string, error) {
     dirname := filepath.Dir(filePath)
     list := make([]string, 0)
@@ -589,15 +589,28 @@ func ReadSeriesList(filePath string) ([]string, error) {
         return nil, err
     }
 
+    isDir := IsDir(filePath)
     for _, entry := range entries {
-        ext := strings.ToLower(filepath.Ext(entry.Name()))
-        if !validCBXExt(ext){
-            continue
-        }
         entryPath := filepath.Join(dirname, entry.Name())
+        if isDir {
+            if strings.HasPrefix(entry.Name(), ".") || 
+                !(entry.IsDir() || isDirLink(entry, entryPath)) ||
+                !hasImages(entryPath) {
+                continue
+            }
+        } else {
+            ext := strings.ToLower(filepath.Ext(entry.Name()))
+            if !validCBXExt(ext){
+                continue
+            }
+            // Later volumes of a rar are read with the first
+            if _, ok := FirstRarVolume(entryPath); ok {
+                continue
+            }
+        }
         list = append(list, entryPath)
     }
-    sort.Strings(list)
+    SortNatural(list)
     return list, nil
 }
 
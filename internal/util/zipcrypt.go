@@ -0,0 +1,336 @@
+package util
+
+import (
+    "archive/zip"
+    "compress/flate"
+    "crypto/aes"
+    "crypto/cipher"
+    "crypto/hmac"
+    "crypto/pbkdf2"
+    "crypto/sha1"
+    "encoding/binary"
+    "errors"
+    "fmt"
+    "hash"
+    "hash/crc32"
+    "io"
+)
+
+/*
+ * Encrypted zip entries have bit 0 of their flags set and are either
+ * in the original pkware cipher, (weak, but it's what most tools still
+ * make), or winzip's aes. archive/zip reads neither, so the raw entry
+ * is decrypted here and then decompressed.
+ */
+const ZIP_FLAG_ENCRYPTED = 0x1
+const ZIP_FLAG_DATA_DESCRIPTOR = 0x8
+
+// Aes entries have this method, the real one is in the aes extra field
+const ZIP_METHOD_AES = 99
+const ZIP_EXTRA_AES = 0x9901
+
+const ZIPCRYPTO_HEADER_LEN = 12
+const ZIP_AES_VERIFIER_LEN = 2
+const ZIP_AES_MAC_LEN = 10
+const ZIP_AES_ITERATIONS = 1000
+
+var errZipAesExtra = errors.New("missing or bad aes extra field")
+var errZipAesAuth = errors.New("aes authentication failed")
+
+func zipEncrypted(f *zip.File) bool {
+    return f.Flags&ZIP_FLAG_ENCRYPTED != 0
+}
+
+func openEncryptedZipEntry(f *zip.File, password string) (io.ReadCloser, error) {
+    if password == "" {
+        return nil, ErrPasswordRequired
+    }
+    raw, err := f.OpenRaw()
+    if err != nil {
+        return nil, err
+    }
+
+    var r io.Reader
+    var ar *zipAesReader
+    method := f.Method
+    checkCRC := true
+    if f.Method == ZIP_METHOD_AES {
+        ae, err := parseZipAesExtra(f.Extra)
+        if err != nil {
+            return nil, err
+        }
+        ar, err = newZipAesReader(raw, int64(f.CompressedSize64), password, ae.strength)
+        if err != nil {
+            return nil, err
+        }
+        r = ar
+        method = ae.method
+
+        // AE-2 leaves the crc out, the mac covers it
+        checkCRC = ae.version == 1
+    } else {
+        r, err = newZipCryptoReader(raw, password, zipCryptoCheck(f))
+        if err != nil {
+            return nil, err
+        }
+    }
+
+    var rc io.ReadCloser
+    switch method {
+    case zip.Store:
+        rc = io.NopCloser(r)
+    case zip.Deflate:
+        rc = flate.NewReader(r)
+    default:
+        return nil, zip.ErrAlgorithm
+    }
+    if ar != nil {
+        rc = &zipMacReader{rc: rc, aes: ar}
+    }
+    if checkCRC {
+        rc = &zipChecksumReader{rc: rc, h: crc32.NewIEEE(), want: f.CRC32}
+    }
+    return rc, nil
+}
+
+/*
+ * Opening an entry checks the password against its header. For aes
+ * that lets 1 in 65536 wrong ones through, but for zipcrypto it's 1 in
+ * 256, so a zipcrypto entry is read to the end as well, a wrong password
+ * that got past the header breaks the deflate or the crc.
+ */
+func checkZipPassword(f *zip.File, password string) error {
+    r, err := openEncryptedZipEntry(f, password)
+    if err != nil {
+        return err
+    }
+    defer r.Close()
+    if f.Method == ZIP_METHOD_AES {
+        return nil
+    }
+    if _, err := io.Copy(io.Discard, r); err != nil {
+        return fmt.Errorf("%w; %s", ErrBadPassword, err)
+    }
+    return nil
+}
+
+// The traditional pkware cipher, three keys updated with every byte
+type zipCryptoReader struct {
+    r    io.Reader
+    keys [3]uint32
+}
+
+func newZipCryptoReader(r io.Reader, password string, check byte) (*zipCryptoReader, error) {
+    z := &zipCryptoReader{r: r, keys: [3]uint32{0x12345678, 0x23456789, 0x34567890}}
+    for i := 0; i < len(password); i++ {
+        z.update(password[i])
+    }
+
+    // The last byte of the header is a check on the password, it
+    // lets 1 in 256 wrong ones through, the crc catches those
+    hdr := make([]byte, ZIPCRYPTO_HEADER_LEN)
+    _, err := io.ReadFull(r, hdr)
+    if err != nil {
+        return nil, err
+    }
+    z.decrypt(hdr)
+    if hdr[ZIPCRYPTO_HEADER_LEN-1] != check {
+        return nil, ErrBadPassword
+    }
+    return z, nil
+}
+
+// What the last byte of f's zipcrypto header should decrypt to, the top
+// of the crc, or of the time when the crc comes after the data
+func zipCryptoCheck(f *zip.File) byte {
+    if f.Flags&ZIP_FLAG_DATA_DESCRIPTOR != 0 {
+        return byte(f.ModifiedTime >> 8)
+    }
+    return byte(f.CRC32 >> 24)
+}
+
+func crc32Update(crc uint32, b byte) uint32 {
+    return crc32.IEEETable[byte(crc)^b] ^ (crc >> 8)
+}
+
+func (z *zipCryptoReader) update(b byte) {
+    z.keys[0] = crc32Update(z.keys[0], b)
+    z.keys[1] = (z.keys[1]+(z.keys[0]&0xff))*134775813 + 1
+    z.keys[2] = crc32Update(z.keys[2], byte(z.keys[1]>>24))
+}
+
+func (z *zipCryptoReader) decrypt(buf []byte) {
+    for i := range buf {
+        t := uint16(z.keys[2] | 2)
+        buf[i] ^= byte((t * (t ^ 1)) >> 8)
+        z.update(buf[i])
+    }
+}
+
+func (z *zipCryptoReader) Read(p []byte) (int, error) {
+    n, err := z.r.Read(p)
+    z.decrypt(p[:n])
+    return n, err
+}
+
+type zipAesExtra struct {
+    version  uint16
+    strength byte
+    method   uint16
+}
+
+func parseZipAesExtra(extra []byte) (zipAesExtra, error) {
+    for len(extra) >= 4 {
+        id := binary.LittleEndian.Uint16(extra[0:2])
+        size := int(binary.LittleEndian.Uint16(extra[2:4]))
+        extra = extra[4:]
+        if size > len(extra) {
+            break
+        }
+        if id == ZIP_EXTRA_AES && size >= 7 {
+            return zipAesExtra{
+                version:  binary.LittleEndian.Uint16(extra[0:2]),
+                strength: extra[4],
+                method:   binary.LittleEndian.Uint16(extra[5:7]),
+            }, nil
+        }
+        extra = extra[size:]
+    }
+    return zipAesExtra{}, errZipAesExtra
+}
+
+/*
+ * Winzip aes, the entry is a salt, a password verifier, the data in aes
+ * ctr mode with a little endian counter starting at 1, and a truncated
+ * hmac of the encrypted data. Keys come from pbkdf2 of the password.
+ */
+type zipAesReader struct {
+    data   io.Reader
+    raw    io.Reader
+    block  cipher.Block
+    mac    hash.Hash
+    ctr    [aes.BlockSize]byte
+    stream [aes.BlockSize]byte
+    used   int
+    done   bool
+    err    error
+}
+
+func newZipAesReader(raw io.Reader, size int64, password string, strength byte) (*zipAesReader, error) {
+    if strength < 1 || strength > 3 {
+        return nil, errZipAesExtra
+    }
+    keyLen := 8 + 8*int(strength)
+    saltLen := keyLen / 2
+    dataLen := size - int64(saltLen+ZIP_AES_VERIFIER_LEN+ZIP_AES_MAC_LEN)
+    if dataLen < 0 {
+        return nil, io.ErrUnexpectedEOF
+    }
+
+    hdr := make([]byte, saltLen+ZIP_AES_VERIFIER_LEN)
+    _, err := io.ReadFull(raw, hdr)
+    if err != nil {
+        return nil, err
+    }
+    keys, err := pbkdf2.Key(sha1.New, password, hdr[:saltLen], ZIP_AES_ITERATIONS,
+        2*keyLen+ZIP_AES_VERIFIER_LEN)
+    if err != nil {
+        return nil, err
+    }
+    if !hmac.Equal(keys[2*keyLen:], hdr[saltLen:]) {
+        return nil, ErrBadPassword
+    }
+
+    block, err := aes.NewCipher(keys[:keyLen])
+    if err != nil {
+        return nil, err
+    }
+    return &zipAesReader{
+        data:  io.LimitReader(raw, dataLen),
+        raw:   raw,
+        block: block,
+        mac:   hmac.New(sha1.New, keys[keyLen:2*keyLen]),
+        used:  aes.BlockSize,
+    }, nil
+}
+
+func (z *zipAesReader) Read(p []byte) (int, error) {
+    n, err := z.data.Read(p)
+    z.mac.Write(p[:n])
+    for i := 0; i < n; i++ {
+        if z.used == aes.BlockSize {
+            for j := range z.ctr {
+                z.ctr[j]++
+                if z.ctr[j] != 0 {
+                    break
+                }
+            }
+            z.block.Encrypt(z.stream[:], z.ctr[:])
+            z.used = 0
+        }
+        p[i] ^= z.stream[z.used]
+        z.used++
+    }
+    if err == io.EOF {
+        if !z.done {
+            z.done = true
+            z.err = z.checkMac()
+        }
+        if z.err != nil {
+            return n, z.err
+        }
+    }
+    return n, err
+}
+
+func (z *zipAesReader) checkMac() error {
+    code := make([]byte, ZIP_AES_MAC_LEN)
+    if _, err := io.ReadFull(z.raw, code); err != nil {
+        return err
+    }
+    if !hmac.Equal(code, z.mac.Sum(nil)[:ZIP_AES_MAC_LEN]) {
+        return errZipAesAuth
+    }
+    return nil
+}
+
+// Deflate can stop at the end of its last block without reading to the
+// end of the data, or leave the mac's error in its buffer, so the rest
+// is read and the mac checked when the entry ends
+type zipMacReader struct {
+    rc  io.ReadCloser
+    aes *zipAesReader
+}
+
+func (z *zipMacReader) Read(p []byte) (int, error) {
+    n, err := z.rc.Read(p)
+    if err == io.EOF {
+        if _, err := io.Copy(io.Discard, z.aes); err != nil {
+            return n, err
+        }
+    }
+    return n, err
+}
+
+func (z *zipMacReader) Close() error {
+    return z.rc.Close()
+}
+
+type zipChecksumReader struct {
+    rc   io.ReadCloser
+    h    hash.Hash32
+    want uint32
+}
+
+func (z *zipChecksumReader) Read(p []byte) (int, error) {
+    n, err := z.rc.Read(p)
+    z.h.Write(p[:n])
+    if err == io.EOF && z.h.Sum32() != z.want {
+        return n, zip.ErrChecksum
+    }
+    return n, err
+}
+
+func (z *zipChecksumReader) Close() error {
+    return z.rc.Close()
+}
@@ -0,0 +1,112 @@
+package util
+
+import (
+    "archive/zip"
+    "bytes"
+    "errors"
+    "fmt"
+    "os"
+    "path/filepath"
+    "testing"
+)
+
+// The fixtures are made by testdata/zipcrypt/mkfixtures.py
+const testZipPassword = "cbxv-secret"
+
+func zipFixture(name string) string {
+    return filepath.Join("testdata", "zipcrypt", name)
+}
+
+func TestEncryptedZip(t *testing.T) {
+    want, err := os.ReadFile(zipFixture("page.txt.golden"))
+    if err != nil {
+        t.Fatal(err)
+    }
+
+    tests := []struct {
+        fixture  string
+        password string
+        openErr  error
+        readErr  error
+    }{
+        {"zipcrypto.zip", testZipPassword, nil, nil},
+        {"zipcrypto-crc.zip", testZipPassword, nil, nil},
+        {"aes128-ae1.zip", testZipPassword, nil, nil},
+        {"aes128-ae2.zip", testZipPassword, nil, nil},
+        {"aes256-ae1.zip", testZipPassword, nil, nil},
+        {"aes256-ae2.zip", testZipPassword, nil, nil},
+        {"zipcrypto.zip", "", ErrPasswordRequired, nil},
+        {"aes256-ae2.zip", "", ErrPasswordRequired, nil},
+        {"zipcrypto.zip", "wrong", ErrBadPassword, nil},
+        {"zipcrypto-crc.zip", "wrong", ErrBadPassword, nil},
+        {"aes128-ae1.zip", "wrong", ErrBadPassword, nil},
+        {"aes256-ae2.zip", "wrong", ErrBadPassword, nil},
+        {"aes256-badmac.zip", testZipPassword, nil, errZipAesAuth},
+    }
+    for _, tt := range tests {
+        t.Run(fmt.Sprintf("%s/%q", tt.fixture, tt.password), func(t *testing.T) {
+            src, err := OpenPageSource(zipFixture(tt.fixture), OpenOptions{Password: tt.password})
+            if !errors.Is(err, tt.openErr) {
+                t.Fatalf("open: got %v, want %v", err, tt.openErr)
+            }
+            if err != nil {
+                return
+            }
+            defer src.Close()
+
+            b, err := src.ReadEntry("page.txt")
+            if !errors.Is(err, tt.readErr) {
+                t.Fatalf("read: got %v, want %v", err, tt.readErr)
+            }
+            if err == nil && !bytes.Equal(b, want) {
+                t.Fatalf("read %d bytes that don't match", len(b))
+            }
+        })
+    }
+}
+
+// 1 in 256 wrong passwords get past the check byte in the zipcrypto
+// header, those have to fail the open too, not break every page. The
+// check is on the time in zipcrypto.zip and on the crc in the other
+func TestZipCryptoWrongPasswordPastCheck(t *testing.T) {
+    tests := []struct {
+        fixture    string
+        descriptor bool
+    }{
+        {"zipcrypto.zip", true},
+        {"zipcrypto-crc.zip", false},
+    }
+    for _, tt := range tests {
+        t.Run(tt.fixture, func(t *testing.T) {
+            r, err := zip.OpenReader(zipFixture(tt.fixture))
+            if err != nil {
+                t.Fatal(err)
+            }
+            defer r.Close()
+            f := r.File[0]
+            if (f.Flags&ZIP_FLAG_DATA_DESCRIPTOR != 0) != tt.descriptor {
+                t.Fatalf("flags %#x, want a data descriptor %v", f.Flags, tt.descriptor)
+            }
+
+            var password string
+            for i := 0; i < 10000 && password == ""; i++ {
+                p := fmt.Sprintf("wrong-%d", i)
+                raw, err := f.OpenRaw()
+                if err != nil {
+                    t.Fatal(err)
+                }
+                if _, err := newZipCryptoReader(raw, p, zipCryptoCheck(f)); err == nil {
+                    password = p
+                }
+            }
+            if password == "" {
+                t.Fatal("no wrong password got past the check byte")
+            }
+
+            _, err = OpenPageSource(zipFixture(tt.fixture), OpenOptions{Password: password})
+            if !errors.Is(err, ErrBadPassword) {
+                t.Fatalf("open with %q: got %v, want %v", password, err, ErrBadPassword)
+            }
+        })
+    }
+}